@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Length of an OPT RR without option, which is added to the response after the additional section processing
+const optLen = 11
+
+// additionalTargets return the names whose addresses are useful to the client to use the RRs: the mail exchangers,
+// the name servers and the targets of the services. c.f RFC 1035 section 3.3 and RFC 2782
+func additionalTargets(rrs []dns.RR) (targets []string) {
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.MX:
+			targets = append(targets, rr.Mx)
+		case *dns.NS:
+			targets = append(targets, rr.Ns)
+		case *dns.SRV:
+			targets = append(targets, rr.Target)
+		}
+	}
+
+	return
+}
+
+// addAdditional copy in the additional section the A and AAAA RRsets of the targets of the answer which are
+// in our zones. c.f step 4 of RFC 1034 section 4.3.2
+// The additional data is optional, so it never truncates the response: an RRset which doesn't fit in the size
+// allowed for the response isn't added, and the following ones neither. c.f RFC 2181 section 9
+func (h *QuestionResolverHandler) addAdditional(msg *dns.Msg, dnssecOK bool, edns bool, maxSize int) {
+	if edns {
+		maxSize -= optLen
+	}
+
+	// The response is measured as it will be packed, compressed when it's too big otherwise
+	compress := msg.Compress
+	msg.Compress = true
+	defer func() { msg.Compress = compress }()
+
+	added := map[string]bool{}
+
+	for _, target := range additionalTargets(msg.Answer) {
+		target = dns.Fqdn(target)
+
+		if added[target] || !h.isALocalRecord(target) || h.zoneCut(target, dns.TypeA) != "" {
+			continue
+		}
+
+		added[target] = true
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			rrset := h.localRRset(target, qtype)
+
+			if len(rrset) == 0 {
+				continue
+			}
+
+			if dnssecOK && h.signer != nil {
+				rrset = h.signer.Sign(rrset)
+			}
+
+			msg.Extra = append(msg.Extra, rrset...)
+
+			if msg.Len() > maxSize {
+				msg.Extra = msg.Extra[:len(msg.Extra)-len(rrset)]
+				return
+			}
+		}
+	}
+}
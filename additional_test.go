@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type AdditionalTestSuite struct {
+	suite.Suite
+	handler QuestionResolverHandler
+}
+
+func (suite *AdditionalTestSuite) SetupTest() {
+	rrsets := [][]dns.RR{
+		{testRR("internal. 3600 IN MX 10 mail.internal."), testRR("internal. 3600 IN MX 20 mx.example.com.")},
+		{testRR("internal. 3600 IN NS ns1.internal.")},
+		{testRR("mail.internal. 3600 IN A 192.0.2.1")},
+		{testRR("mail.internal. 3600 IN AAAA 2001:db8::1")},
+		{testRR("ns1.internal. 3600 IN A 192.0.2.53")},
+		{testRR("_sip._tcp.internal. 3600 IN SRV 0 5 5060 sip.internal.")},
+		{testRR("sip.internal. 3600 IN CNAME mail.internal.")},
+		{testRR("big.internal. 3600 IN MX 10 many.internal.")},
+	}
+
+	many := []dns.RR{}
+
+	for i := 1; i <= 40; i++ {
+		many = append(many, testRR(fmt.Sprintf("many.internal. 3600 IN A 192.0.2.%d", i)))
+	}
+
+	rrsets = append(rrsets, many)
+
+	suite.handler = newTestHandler(DnsConfig{Zones: []string{"internal."}}, rrsets...)
+}
+
+func (suite *AdditionalTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *AdditionalTestSuite) query(qname string, qtype uint16) *dns.Msg {
+	w := newTestUDPResponseWriter()
+	suite.handler.ServeDNS(w, new(dns.Msg).SetQuestion(qname, qtype))
+
+	return w.msg
+}
+
+func (suite *AdditionalTestSuite) TestShouldAddTheAddressesOfTheTargetsInOurZones() {
+	tests := []struct {
+		qname string
+		qtype uint16
+		extra []string
+	}{
+		{"internal.", dns.TypeMX, []string{"mail.internal.\t3600\tIN\tA\t192.0.2.1", "mail.internal.\t3600\tIN\tAAAA\t2001:db8::1"}},
+		{"internal.", dns.TypeNS, []string{"ns1.internal.\t3600\tIN\tA\t192.0.2.53"}},
+		// The target of a service can't be an alias, the CNAME isn't followed. c.f RFC 2782
+		{"_sip._tcp.internal.", dns.TypeSRV, []string{}},
+		{"mail.internal.", dns.TypeA, []string{}},
+	}
+
+	for _, test := range tests {
+		msg := suite.query(test.qname, test.qtype)
+		extra := []string{}
+
+		for _, rr := range msg.Extra {
+			extra = append(extra, rr.String())
+		}
+
+		suite.Equal(test.extra, extra, test.qname)
+	}
+}
+
+func (suite *AdditionalTestSuite) TestShouldNotTruncateTheResponseForTheAdditionalData() {
+	msg := suite.query("big.internal.", dns.TypeMX)
+
+	suite.False(msg.Truncated)
+	suite.Len(msg.Answer, 1)
+	suite.Empty(msg.Extra, "the addresses don't fit in 512 bytes")
+
+	m := new(dns.Msg).SetQuestion("big.internal.", dns.TypeMX)
+	m.SetEdns0(4096, false)
+	w := newTestUDPResponseWriter()
+	suite.handler.ServeDNS(w, m)
+
+	suite.False(w.msg.Truncated)
+	suite.Len(w.msg.Extra, 41, "the addresses and the OPT RR")
+}
+
+func TestAdditionalTestSuite(t *testing.T) {
+	suite.Run(t, new(AdditionalTestSuite))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Listeners of the DNS server, each one has its own ACL
+const (
+	ListenerUDP   = "udp"
+	ListenerTCP   = "tcp"
+	ListenerTLS   = "tls"
+	ListenerHTTPS = "https"
+	ListenerQUIC  = "quic"
+)
+
+// Listeners is the list of the listeners of the DNS server
+var Listeners = []string{ListenerUDP, ListenerTCP, ListenerTLS, ListenerHTTPS, ListenerQUIC}
+
+// Actions of the admission control for the rejected queries
+const (
+	AdmissionRefuse = "refuse" // the query is answered REFUSED
+	AdmissionDrop   = "drop"   // the query isn't answered, the TCP connection is closed
+)
+
+// Reasons of the rejection of a query by the admission control, they are used as metric names
+const (
+	AdmissionDenied                = "admission-denied"
+	AdmissionRateLimited           = "admission-rate-limited"
+	AdmissionTooManyTCPConnections = "admission-too-many-tcp-connections"
+)
+
+// AdmissionController decides which queries are served, before any work is done for them: the client must be allowed
+// on the listener, under its rate of queries, and under its number of TCP connections. A nil AdmissionController admits everything.
+type AdmissionController struct {
+	allowed           map[string][]*net.IPNet // by listener, every client is allowed when it's empty
+	denied            map[string][]*net.IPNet // by listener
+	rate              float64                 // queries by second of a client, unlimited when it's 0
+	burst             float64
+	maxTCPConnections int
+	action            string
+	mutex             sync.Mutex
+	buckets           map[string]*utils.TokenBucket // by IP of the client
+	connections       map[string]int                // TCP connections by IP of the client
+	lastPrune         time.Time
+	now               func() time.Time
+}
+
+// NewAdmissionController create the admission control of the configuration, nil when it has nothing to control
+func NewAdmissionController(config AdmissionConfig) (*AdmissionController, error) {
+	a := &AdmissionController{
+		allowed:           make(map[string][]*net.IPNet),
+		denied:            make(map[string][]*net.IPNet),
+		rate:              float64(config.QueriesPerSecond),
+		burst:             float64(config.Burst),
+		maxTCPConnections: config.MaxTCPConnections,
+		action:            config.Action,
+		buckets:           make(map[string]*utils.TokenBucket),
+		connections:       make(map[string]int),
+		now:               time.Now,
+	}
+
+	enabled := a.rate > 0 || a.maxTCPConnections > 0
+
+	for _, listener := range Listeners {
+		var err error
+
+		if a.allowed[listener], err = utils.ParseCIDRs(config.AllowedIPs[listener]); err != nil {
+			return nil, fmt.Errorf("invalid allowed IPs of the listener %s: %s", listener, err)
+		}
+
+		if a.denied[listener], err = utils.ParseCIDRs(config.DeniedIPs[listener]); err != nil {
+			return nil, fmt.Errorf("invalid denied IPs of the listener %s: %s", listener, err)
+		}
+
+		enabled = enabled || len(a.allowed[listener]) > 0 || len(a.denied[listener]) > 0
+	}
+
+	switch a.action {
+	case "":
+		a.action = AdmissionRefuse
+	case AdmissionRefuse, AdmissionDrop:
+	default:
+		return nil, fmt.Errorf("unknown admission action %s, must be %s or %s", a.action, AdmissionRefuse, AdmissionDrop)
+	}
+
+	// The burst is one second of queries by default
+	if a.burst < a.rate {
+		a.burst = a.rate
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	return a, nil
+}
+
+// Admit look if a query of the client on the listener is served.
+// It returns the reason of the rejection, or an empty string when the query is admitted.
+func (a *AdmissionController) Admit(listener string, ip net.IP) string {
+	if a == nil {
+		return ""
+	}
+
+	if utils.ContainsIP(a.denied[listener], ip) || (len(a.allowed[listener]) > 0 && !utils.ContainsIP(a.allowed[listener], ip)) {
+		return AdmissionDenied
+	}
+
+	if a.rate <= 0 || ip == nil {
+		return ""
+	}
+
+	key := ip.String()
+	now := a.now()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.prune(now)
+	bucket, found := a.buckets[key]
+
+	if !found {
+		bucket = utils.NewTokenBucket(now, a.burst)
+		a.buckets[key] = bucket
+	}
+
+	if !bucket.Take(now, a.rate, a.burst) {
+		return AdmissionRateLimited
+	}
+
+	return ""
+}
+
+// prune remove the buckets of the clients which are under their rate again
+func (a *AdmissionController) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < RrlPruneInterval {
+		return
+	}
+
+	for key, bucket := range a.buckets {
+		if bucket.Full(now, a.rate, a.burst) {
+			delete(a.buckets, key)
+		}
+	}
+
+	a.lastPrune = now
+}
+
+// openConnection count a new TCP connection of the client, it returns false when the client has too many connections
+func (a *AdmissionController) openConnection(ip net.IP) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.connections[ip.String()] >= a.maxTCPConnections {
+		return false
+	}
+
+	a.connections[ip.String()]++
+	return true
+}
+
+func (a *AdmissionController) closeConnection(ip net.IP) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.connections[ip.String()]--; a.connections[ip.String()] <= 0 {
+		delete(a.connections, ip.String())
+	}
+}
+
+// ListenerHandler return the handler of the queries of a listener, which serves only the admitted queries
+func (h *QuestionResolverHandler) ListenerHandler(listener string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		reason := h.admission.Admit(listener, utils.IPFromAddr(w.RemoteAddr()))
+
+		if reason == "" {
+			h.ServeDNS(w, r)
+			return
+		}
+
+		log.WithFields(log.Fields{"ip": w.RemoteAddr().String(), "listener": listener, "reason": reason}).Debug("Rejected a DNS query by the admission control")
+		h.incMetric(reason)
+
+		if h.admission.action == AdmissionDrop {
+			// A TCP connection is closed, the client would wait for the response until its timeout otherwise
+			if isTCP(w) {
+				w.Close()
+			}
+
+			return
+		}
+
+		h.writeRcode(w, r, dns.RcodeRefused)
+	})
+}
+
+// limitConnections wrap the TCP listener so a client can't open more than the maximum of connections
+func (h *QuestionResolverHandler) limitConnections(l net.Listener) net.Listener {
+	if h.admission == nil || h.admission.maxTCPConnections <= 0 {
+		return l
+	}
+
+	return &connLimitListener{Listener: l, admission: h.admission, incMetric: h.incMetric}
+}
+
+type connLimitListener struct {
+	net.Listener
+	admission *AdmissionController
+	incMetric func(metricName string)
+}
+
+// Accept return the next connection of a client under its maximum, the other ones are closed right away
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+
+		if err != nil {
+			return nil, err
+		}
+
+		ip := utils.IPFromAddr(conn.RemoteAddr())
+
+		if l.admission.openConnection(ip) {
+			return &connLimitConn{Conn: conn, admission: l.admission, ip: ip}, nil
+		}
+
+		log.WithField("ip", conn.RemoteAddr().String()).Debug("Rejected a TCP connection by the admission control")
+		l.incMetric(AdmissionTooManyTCPConnections)
+		conn.Close()
+	}
+}
+
+// connLimitConn is a connection counted by the admission control until it's closed
+type connLimitConn struct {
+	net.Conn
+	admission *AdmissionController
+	ip        net.IP
+	once      sync.Once
+}
+
+func (c *connLimitConn) Close() error {
+	c.once.Do(func() { c.admission.closeConnection(c.ip) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AdmissionTestSuite struct {
+	suite.Suite
+	handler QuestionResolverHandler
+	now     time.Time
+}
+
+func (suite *AdmissionTestSuite) SetupTest() {
+	suite.newHandler(AdmissionConfig{
+		AllowedIPs:        map[string][]string{ListenerTCP: {"10.0.0.0/8"}},
+		DeniedIPs:         map[string][]string{ListenerUDP: {"192.0.2.0/24"}},
+		QueriesPerSecond:  2,
+		Burst:             3,
+		MaxTCPConnections: 1,
+	})
+}
+
+func (suite *AdmissionTestSuite) newHandler(config AdmissionConfig) {
+	db := newTestDB([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")})
+
+	suite.handler = NewQuestionResolverHandler(db, nil, NewResponseCache(0), DnsConfig{Zones: []string{"internal."}, Admission: config}, nil)
+	suite.now = time.Now()
+	suite.handler.admission.now = func() time.Time { return suite.now }
+}
+
+func (suite *AdmissionTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+// query ask foo.internal. on the listener from the address, it returns nil when the query is dropped
+func (suite *AdmissionTestSuite) query(listener string, ip string) *dns.Msg {
+	w := newTestUDPResponseWriter()
+	w.remoteAddr = &net.UDPAddr{IP: net.ParseIP(ip), Port: 4242}
+	suite.handler.ListenerHandler(listener).ServeDNS(w, new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+
+	return w.msg
+}
+
+func (suite *AdmissionTestSuite) TestShouldRefuseTheClientsDeniedOnTheListener() {
+	msg := suite.query(ListenerUDP, "192.0.2.1")
+
+	if suite.NotNil(msg) {
+		suite.Equal(dns.RcodeRefused, msg.Rcode)
+		suite.Empty(msg.Answer)
+	}
+
+	msg = suite.query(ListenerTCP, "192.0.2.1")
+
+	if suite.NotNil(msg, "the client isn't in the allowed IPs of the TCP listener") {
+		suite.Equal(dns.RcodeRefused, msg.Rcode)
+	}
+
+	msg = suite.query(ListenerTLS, "192.0.2.1")
+
+	if suite.NotNil(msg, "the ACLs of a listener don't apply to the other ones") {
+		suite.Equal(dns.RcodeSuccess, msg.Rcode)
+		suite.Len(msg.Answer, 1)
+	}
+
+	msg = suite.query(ListenerTCP, "10.0.0.1")
+
+	if suite.NotNil(msg) {
+		suite.Equal(dns.RcodeSuccess, msg.Rcode)
+	}
+}
+
+func (suite *AdmissionTestSuite) TestShouldLimitTheQueriesOfAClientAfterItsBurst() {
+	for i := 0; i < 3; i++ {
+		suite.Equal(dns.RcodeSuccess, suite.query(ListenerUDP, "198.51.100.1").Rcode)
+	}
+
+	suite.Equal(dns.RcodeRefused, suite.query(ListenerUDP, "198.51.100.1").Rcode)
+	suite.Equal(dns.RcodeSuccess, suite.query(ListenerQUIC, "198.51.100.2").Rcode, "another client has its own rate")
+
+	// The client gets 2 queries by second
+	suite.now = suite.now.Add(time.Second)
+
+	for i := 0; i < 2; i++ {
+		suite.Equal(dns.RcodeSuccess, suite.query(ListenerUDP, "198.51.100.1").Rcode)
+	}
+
+	suite.Equal(dns.RcodeRefused, suite.query(ListenerUDP, "198.51.100.1").Rcode)
+}
+
+func (suite *AdmissionTestSuite) TestShouldDropTheRejectedQueries() {
+	closeTestDB(suite.handler.db)
+	suite.newHandler(AdmissionConfig{DeniedIPs: map[string][]string{ListenerHTTPS: {"192.0.2.1"}}, Action: AdmissionDrop})
+
+	suite.Nil(suite.query(ListenerHTTPS, "192.0.2.1"))
+	suite.NotNil(suite.query(ListenerHTTPS, "192.0.2.2"))
+}
+
+func (suite *AdmissionTestSuite) TestShouldCloseTheDohConnectionsOverTheMaximum() {
+	id := uuid.New().String()
+	tlsConfig := TlsConfig{CertFile: fmt.Sprintf("/tmp/%s.crt", id), KeyFile: fmt.Sprintf("/tmp/%s.key", id)}
+	defer os.Remove(tlsConfig.CertFile)
+	defer os.Remove(tlsConfig.KeyFile)
+
+	if !suite.Nil(writeTestCertificate(tlsConfig.CertFile, tlsConfig.KeyFile, "dns.internal")) {
+		return
+	}
+
+	server, err := NewDohServer(&suite.handler, DohConfig{})
+	suite.Nil(err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	defer l.Close()
+	go server.Serve(l, tlsConfig)
+
+	clientConfig := &tls.Config{InsecureSkipVerify: true, ServerName: "dns.internal"}
+	first, err := tls.Dial("tcp", l.Addr().String(), clientConfig)
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	defer first.Close()
+
+	_, err = tls.Dial("tcp", l.Addr().String(), clientConfig)
+	suite.NotNil(err, "the second connection of the client is closed")
+}
+
+func (suite *AdmissionTestSuite) TestShouldCloseTheTCPConnectionsOverTheMaximum() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	listener := suite.handler.limitConnections(l)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 3)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	first, _ := net.Dial("tcp", l.Addr().String())
+	defer first.Close()
+	conn := <-accepted
+
+	second, _ := net.Dial("tcp", l.Addr().String())
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	suite.Equal(io.EOF, err, "the second connection of the client is closed")
+	suite.Len(accepted, 0)
+
+	// The client can open a connection again once the first one is closed
+	conn.Close()
+	third, _ := net.Dial("tcp", l.Addr().String())
+	defer third.Close()
+
+	select {
+	case conn = <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		suite.Fail("the third connection isn't accepted")
+	}
+}
+
+func TestShouldRejectAnInvalidAdmissionConfig(t *testing.T) {
+	admission, err := NewAdmissionController(AdmissionConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, admission, "the admission control is disabled without configuration")
+
+	_, err = NewAdmissionController(AdmissionConfig{DeniedIPs: map[string][]string{ListenerUDP: {"not an ip"}}})
+	assert.NotNil(t, err)
+
+	_, err = NewAdmissionController(AdmissionConfig{QueriesPerSecond: 10, Action: "ignore"})
+	assert.NotNil(t, err)
+}
+
+func TestAdmissionTestSuite(t *testing.T) {
+	suite.Run(t, new(AdmissionTestSuite))
+}
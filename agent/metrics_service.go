@@ -2,6 +2,7 @@ package agent
 
 import (
 	"stream-dns/metrics"
+	"sync"
 	"time"
 )
 
@@ -12,6 +13,7 @@ type MetricsService struct {
 	InputAgent    chan metrics.Metric
 	aggregators   map[string]Aggregator
 	flushInterval time.Duration
+	mutex         *sync.Mutex // the DNS handlers use the service from many goroutines
 }
 
 func NewMetricsService(inputAgent chan metrics.Metric, flushInterval time.Duration) MetricsService {
@@ -19,10 +21,14 @@ func NewMetricsService(inputAgent chan metrics.Metric, flushInterval time.Durati
 		InputAgent:    inputAgent,
 		aggregators:   map[string]Aggregator{},
 		flushInterval: flushInterval,
+		mutex:         &sync.Mutex{},
 	}
 }
 
 func (m MetricsService) GetOrCreateAggregator(metricName string, valueType metrics.ValueType, reset bool) Aggregator {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if m.aggregators[metricName] == nil {
 		switch valueType {
 		case metrics.Counter:
@@ -39,5 +45,8 @@ func (m MetricsService) GetOrCreateAggregator(metricName string, valueType metri
 
 // Use this method only after a GetOrCreateAggregator call in the same block to avoid a nil pointer exceptions.
 func (m MetricsService) Get(metricName string) Aggregator {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	return m.aggregators[metricName]
 }
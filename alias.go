@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// TypeALIAS is the private type of the ALIAS records, the same as PowerDNS. c.f RFC 6895 section 3.1
+const TypeALIAS uint16 = 65401
+
+func init() {
+	dns.PrivateHandle("ALIAS", TypeALIAS, func() dns.PrivateRdata { return new(ALIAS) })
+}
+
+// ALIAS is the RDATA of an ALIAS record: the hostname whose addresses are served at the owner of the record.
+// Unlike a CNAME, an ALIAS can live at a zone apex with other records: the queries A and AAAA are answered
+// with the addresses of the target, as if they were owned by the name (flattening).
+type ALIAS struct {
+	Target string
+}
+
+// String return the presentation format of the RDATA
+func (rd *ALIAS) String() string { return rd.Target }
+
+// Parse read the presentation format of the RDATA
+func (rd *ALIAS) Parse(txt []string) error {
+	if len(txt) != 1 {
+		return fmt.Errorf("the ALIAS must have only one target")
+	}
+
+	if _, ok := dns.IsDomainName(txt[0]); !ok {
+		return fmt.Errorf("invalid target of ALIAS %s", txt[0])
+	}
+
+	rd.Target = utils.ToLowerFQDN(txt[0])
+	return nil
+}
+
+// Pack write the RDATA in the wire format, the target is never compressed
+func (rd *ALIAS) Pack(buf []byte) (int, error) {
+	return dns.PackDomainName(rd.Target, buf, 0, nil, false)
+}
+
+// Unpack read the RDATA in the wire format
+func (rd *ALIAS) Unpack(buf []byte) (int, error) {
+	target, off, err := dns.UnpackDomainName(buf, 0)
+
+	if err != nil {
+		return off, err
+	}
+
+	rd.Target = target
+	return off, nil
+}
+
+// Copy copy the RDATA into dest
+func (rd *ALIAS) Copy(dest dns.PrivateRdata) error {
+	alias, ok := dest.(*ALIAS)
+
+	if !ok {
+		return dns.ErrRdata
+	}
+
+	alias.Target = rd.Target
+	return nil
+}
+
+// Len return the length of the RDATA in the wire format
+func (rd *ALIAS) Len() int {
+	if rd.Target == "." {
+		return 1
+	}
+
+	return len(rd.Target) + 1
+}
+
+// aliasTarget return the target of the ALIAS RR
+func aliasTarget(rr dns.RR) (string, bool) {
+	if private, ok := rr.(*dns.PrivateRR); ok {
+		if alias, ok := private.Data.(*ALIAS); ok {
+			return alias.Target, true
+		}
+	}
+
+	return "", false
+}
+
+// aliasCache keeps the addresses of the targets of the ALIAS resolved out of our zones, until their TTL expires
+type aliasCache struct {
+	mutex   sync.RWMutex
+	entries map[string]aliasCacheEntry // <target>|<qtype> -> addresses
+}
+
+type aliasCacheEntry struct {
+	rrs     []dns.RR
+	expires time.Time
+}
+
+func newAliasCache() *aliasCache {
+	return &aliasCache{entries: make(map[string]aliasCacheEntry)}
+}
+
+func (c *aliasCache) get(key string) ([]dns.RR, bool) {
+	c.mutex.RLock()
+	entry, found := c.entries[key]
+	c.mutex.RUnlock()
+
+	if !found || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	return entry.rrs, true
+}
+
+func (c *aliasCache) set(key string, rrs []dns.RR, ttl uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// The expired entries are dropped on the way, so the targets removed from the ALIAS don't stay forever
+	now := time.Now()
+
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = aliasCacheEntry{rrs: rrs, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// flattenAlias answer a query A or AAAA at a name which owns an ALIAS with the addresses of its target, owned by the qname.
+// The target is resolved in our zones or with the resolver, and the TTL is bounded by the TTL of the addresses.
+func (h *QuestionResolverHandler) flattenAlias(qname string, qtype uint16, alias dns.RR, depth int) ([]dns.RR, error) {
+	target, ok := aliasTarget(alias)
+
+	if !ok {
+		return []dns.RR{}, nil
+	}
+
+	key := target + "|" + dns.TypeToString[qtype]
+	addresses, found := h.aliases.get(key)
+
+	if !found {
+		var err error
+
+		if h.isALocalRecord(target) {
+			// The local data is always fresh, it isn't cached
+			addresses, err = h.lookupRecord(target, qtype, true, depth)
+		} else {
+			addresses, err = h.resolverOf(target).Resolve(target, qtype)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = filterRRsByType(addresses, qtype)
+
+		if ttl := minTTL(addresses); !h.isALocalRecord(target) && ttl > 0 {
+			h.aliases.set(key, addresses, ttl)
+		}
+	}
+
+	rrs := make([]dns.RR, 0, len(addresses))
+
+	for _, address := range addresses {
+		rr := dns.Copy(address)
+		rr.Header().Name = qname
+		rr.Header().Ttl = uint32(utils.Min(int(rr.Header().Ttl), int(alias.Header().Ttl)))
+		rrs = append(rrs, rr)
+	}
+
+	log.WithFields(log.Fields{"qname": qname, "target": target, "answers": rrs}).Debug("Flattened an ALIAS")
+
+	return rrs, nil
+}
+
+// filterRRsByType keep only the RRs of type qtype, e.g: the addresses at the end of a CNAME chain
+func filterRRsByType(rrs []dns.RR, qtype uint16) []dns.RR {
+	filtered := []dns.RR{}
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			filtered = append(filtered, rr)
+		}
+	}
+
+	return filtered
+}
+
+// minTTL return the smallest TTL of the RRs, or 0 when there isn't any RR
+func minTTL(rrs []dns.RR) (ttl uint32) {
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	return
+}
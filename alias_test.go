@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type AliasTestSuite struct {
+	suite.Suite
+	handler  QuestionResolverHandler
+	consumer *KafkaConsumer
+}
+
+func (suite *AliasTestSuite) SetupTest() {
+	db := newTestDB()
+
+	config := DnsConfig{Zones: []string{"internal."}}
+	suite.handler = NewQuestionResolverHandler(db, nil, nil, config, nil)
+	suite.consumer = &KafkaConsumer{db: db, zones: config.Zones}
+
+	suite.register(Record{Name: "internal.", Type: "ALIAS", Content: "lb.internal.", Ttl: 300})
+	suite.register(Record{Name: "internal.", Type: "MX", Content: "mail.internal.", Ttl: 300, Priority: 10})
+	suite.register(Record{Name: "lb.internal.", Type: "CNAME", Content: "lb1.internal.", Ttl: 300})
+	suite.register(Record{Name: "lb1.internal.", Type: "A", Content: "192.0.2.1", Ttl: 60})
+	suite.register(Record{Name: "external.internal.", Type: "ALIAS", Content: "lb.example.com.", Ttl: 30})
+}
+
+func (suite *AliasTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *AliasTestSuite) register(record Record) {
+	rrs, err := MapRecordsIntoRRs([]Record{record})
+	suite.Nil(err)
+	suite.Nil(suite.consumer.registerRecordAsBytesWithTheKeyInDB(utils.Key(record.Name, rrs[0].Header().Rrtype), rrs, false))
+}
+
+func (suite *AliasTestSuite) TestShouldStoreTheALIASRecords() {
+	rrs, err := suite.handler.lookupRecord("internal.", TypeALIAS, true, 0)
+
+	suite.Nil(err)
+	suite.Len(rrs, 1)
+	suite.Equal("internal.\t300\tIN\tALIAS\tlb.internal.", rrs[0].String())
+}
+
+func (suite *AliasTestSuite) TestShouldFlattenALocalTarget() {
+	rcode, rrs := suite.handler.resolveQuestion(dns.Question{Name: "internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, true)
+
+	suite.Equal(dns.RcodeSuccess, rcode)
+	suite.Len(rrs, 1)
+	suite.Equal("internal.\t60\tIN\tA\t192.0.2.1", rrs[0].String(), "the TTL is bounded by the TTL of the target")
+
+	rcode, rrs = suite.handler.resolveQuestion(dns.Question{Name: "internal.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, true)
+	suite.Equal(dns.RcodeSuccess, rcode)
+	suite.Empty(rrs)
+}
+
+func (suite *AliasTestSuite) TestShouldKeepTheOtherRecordsOfTheName() {
+	rrs, err := suite.handler.lookupRecord("internal.", dns.TypeMX, true, 0)
+
+	suite.Nil(err)
+	suite.Len(rrs, 1)
+	suite.Equal(dns.TypeMX, rrs[0].Header().Rrtype)
+}
+
+func (suite *AliasTestSuite) TestShouldFlattenTheCachedAddressesOfAnExternalTarget() {
+	suite.handler.aliases.set("lb.example.com.|A", []dns.RR{testRR("lb.example.com. 120 IN A 198.51.100.1")}, 120)
+
+	rrs, err := suite.handler.lookupRecord("external.internal.", dns.TypeA, true, 0)
+
+	suite.Nil(err)
+	suite.Len(rrs, 1)
+	suite.Equal("external.internal.\t30\tIN\tA\t198.51.100.1", rrs[0].String(), "the TTL is bounded by the TTL of the ALIAS")
+
+	cached, _ := suite.handler.aliases.get("lb.example.com.|A")
+	suite.Equal("lb.example.com.", cached[0].Header().Name, "the cached addresses aren't modified")
+}
+
+func (suite *AliasTestSuite) TestShouldRejectAnInvalidALIAS() {
+	suite.Nil(RecordToRR(Record{Name: "internal.", Type: "ALIAS", Content: "lb.internal. lb2.internal.", Ttl: 300}))
+}
+
+func TestAliasTestSuite(t *testing.T) {
+	suite.Run(t, new(AliasTestSuite))
+}
@@ -39,10 +39,114 @@ type KafkaConfig struct {
 }
 
 type DnsConfig struct {
-	Address string
-	Udp     bool
-	Tcp     bool
-	Zones   []string
+	Address    string
+	Udp        bool
+	Tcp        bool
+	Zones      []string
+	MaxUdpSize uint16 // maximum payload size of the UDP responses advertised with EDNS0
+	Dnssec     DnssecConfig
+	Xfr        XfrConfig
+	Notify     NotifyConfig
+	Soa        SoaConfig
+	TsigKeys   []string // keyring with the format <name>:<algorithm>:<base64 secret>
+	Forward    ForwardConfig
+	Recursion  RecursionConfig
+	Tls        TlsConfig
+	Doh        DohConfig
+	Doq        DoqConfig
+	Rrl        RrlConfig
+	Admission  AdmissionConfig
+	// Maximum number of packed responses in the cache, 10000 by default, the cache is disabled when it's negative
+	ResponseCacheSize int
+}
+
+// ForwardConfig is the configuration of the forwarding mode, which is enabled when there are upstreams
+type ForwardConfig struct {
+	Upstreams           []string // [<transport>://]<address>[:<port>][?timeout=<duration>&servername=<name>]
+	Zones               []string // conditional forwarding rules with the format <zone>=<upstream>[,<upstream>...]
+	Policy              string   // round-robin, sequential or fastest
+	Transport           string   // udp, tcp or tls, the default transport of the upstreams
+	Timeout             time.Duration
+	HealthCheckInterval time.Duration
+}
+
+// TlsConfig is the configuration of the DNS over TLS listener, which is enabled when it has an address
+type TlsConfig struct {
+	Address  string
+	CertFile string // certificate in the PEM format, reloaded when it changes
+	KeyFile  string
+}
+
+// DohConfig is the configuration of the DNS over HTTPS endpoint, which is enabled when it has an address.
+// It uses the certificate of the DNS over TLS listener.
+type DohConfig struct {
+	Address        string
+	Path           string   // /dns-query by default
+	TrustedProxies []string // IPs or CIDRs of the proxies whose X-Forwarded-For is trusted
+}
+
+// DoqConfig is the configuration of the DNS over QUIC listener, which is enabled when it has an address.
+// It uses the certificate of the DNS over TLS listener.
+type DoqConfig struct {
+	Address     string
+	IdleTimeout time.Duration // the connections without activity are closed, 30s by default
+	MaxStreams  int           // maximum number of concurrent queries of a connection, 100 by default
+	Allow0RTT   bool          // accept the queries in the first flight of a resumed connection
+}
+
+// RrlConfig is the configuration of the response rate limiting over UDP, which is enabled when ResponsesPerSecond is set
+type RrlConfig struct {
+	ResponsesPerSecond int      // identical answers sent to a network by second
+	NxdomainsPerSecond int      // NXDOMAIN of a zone sent to a network by second, ResponsesPerSecond by default
+	ErrorsPerSecond    int      // errors sent to a network by second, ResponsesPerSecond by default
+	Slip               int      // one limited response in Slip is truncated instead of dropped, never when it's 0
+	IPv4PrefixLength   int      // the IPv4 clients are grouped by /24 by default
+	IPv6PrefixLength   int      // the IPv6 clients are grouped by /56 by default
+	ExemptIPs          []string // IPs or CIDRs of the clients which aren't limited
+}
+
+// AdmissionConfig is the configuration of the admission control of the queries, in front of the resolution
+type AdmissionConfig struct {
+	AllowedIPs        map[string][]string // IPs or CIDRs of the clients allowed by listener, any client is allowed when it's empty
+	DeniedIPs         map[string][]string // IPs or CIDRs of the clients denied by listener
+	QueriesPerSecond  int                 // queries of a client by second, unlimited when it's 0
+	Burst             int                 // queries of a client above its rate, QueriesPerSecond by default
+	MaxTCPConnections int                 // concurrent TCP connections of a client, over TCP and TLS, unlimited when it's 0
+	Action            string              // refuse (default) or drop the rejected queries
+}
+
+// DefaultAllowedIPs are the networks allowed to recurse or to transfer the zones when the configuration
+// doesn't have any: the loopback and the private networks, so the server is never an open resolver
+// and doesn't give its zones to anyone. c.f RFC 5358
+var DefaultAllowedIPs = []string{"127.0.0.0/8", "::1", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+
+type RecursionConfig struct {
+	Mode       string   // authoritative, recursive or both (default)
+	AllowedIPs []string // IPs or CIDRs of the clients allowed to recurse, the loopback and private networks when it's empty
+}
+
+type DnssecConfig struct {
+	KeysDir           string // directory of the zone keys, DNSSEC is disabled when empty
+	SignatureValidity time.Duration
+}
+
+type XfrConfig struct {
+	Allow      bool     // zone transfers are refused unless DNS_ALLOW_AXFR is set
+	AllowedIPs []string // IPs or CIDRs of the secondaries, the loopback and private networks when it's empty
+	TsigKeys   []string // names of the TSIG keys allowed to transfer the zones, the transfers don't require TSIG when it's empty
+}
+
+type SoaConfig struct {
+	SerialPolicy string // increment (default), date or unixtime
+	Ns           string // primary name server of the synthesized SOA, ns.<zone> by default
+	Mbox         string // mailbox of the synthesized SOA, hostmaster.<zone> by default
+}
+
+type NotifyConfig struct {
+	Secondaries []string      // secondaries notified of the changes, with the format <zone>=<address> or <address> for all the zones
+	Debounce    time.Duration // delay without change in a zone before notifying its secondaries
+	MaxDelay    time.Duration // maximum delay between a change and the NOTIFY, even when the zone keeps changing
+	TsigKey     string        // (optional) name of the TSIG key used to sign the NOTIFY
 }
 
 type AgentConfig struct {
@@ -69,5 +173,5 @@ const ALLOW_AXFR = "ALLOW_AXFR"
 // ex: "allow_axfr" -> "DNS_ALLOW_AXFR"
 // which is the true configuration param and not "allow_axfr".
 func formatConfig(tag string) string {
-	return strings.ToUpper(ENV_PREFIX + "_" + ALLOW_AXFR)
+	return strings.ToUpper(ENV_PREFIX + "_" + tag)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/json"
@@ -33,6 +34,11 @@ type KafkaConsumer struct {
 	configConsumer *cluster.Config
 	consumer       *cluster.Consumer
 	ms             *a.MetricsService
+	zones          []string
+	soa            SoaConfig
+	notifier       *Notifier      // nil when there isn't any secondary to notify
+	zoneCache      *ZoneCache     // nil when the handler reads the DB
+	responseCache  *ResponseCache // nil when the responses aren't cached
 }
 
 var SHA256 scram.HashGeneratorFcn = func() hash.Hash { return sha256.New() }
@@ -62,7 +68,7 @@ func (x *XDGSCRAMClient) Done() bool {
 	return x.ClientConversation.Done()
 }
 
-func NewKafkaConsumer(config KafkaConfig, db *bolt.DB, metricsService *a.MetricsService) (*KafkaConsumer, error) {
+func NewKafkaConsumer(config KafkaConfig, db *bolt.DB, metricsService *a.MetricsService, dnsConfig DnsConfig, notifier *Notifier, zoneCache *ZoneCache, responseCache *ResponseCache) (*KafkaConsumer, error) {
 	brokers := config.Address
 	topics := config.Topics
 	consumerGroup := "stream-dns-" + uuid.New().String()
@@ -73,6 +79,13 @@ func NewKafkaConsumer(config KafkaConfig, db *bolt.DB, metricsService *a.Metrics
 		return nil, err
 	}
 
+	soaConfig := dnsConfig.Soa
+	soaConfig.SerialPolicy, err = ParseSerialPolicy(soaConfig.SerialPolicy)
+
+	if err != nil {
+		return nil, err
+	}
+
 	log.WithFields(log.Fields{
 		"address":   config.Address,
 		"sasl":      config.SaslEnable,
@@ -100,6 +113,11 @@ func NewKafkaConsumer(config KafkaConfig, db *bolt.DB, metricsService *a.Metrics
 		configConsumer: configConsumer,
 		consumer:       consumer,
 		ms:             metricsService,
+		zones:          dnsConfig.Zones,
+		soa:            soaConfig,
+		notifier:       notifier,
+		zoneCache:      zoneCache,
+		responseCache:  responseCache,
 	}, nil
 }
 
@@ -231,7 +249,7 @@ func (c *KafkaConsumer) registerRecordAsBytesWithTheKeyInDB(key []byte, rrs []dn
 		return err
 	}
 
-	rrsRaw, err := json.Marshal(rrs)
+	rrsRaw, err := encodeRRs(rrs)
 
 	if err != nil {
 		return err
@@ -239,32 +257,120 @@ func (c *KafkaConsumer) registerRecordAsBytesWithTheKeyInDB(key []byte, rrs []dn
 
 	err = c.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(RecordBucket))
+		deleted := []dns.RR{}
 
 		if isSubDomain {
 			// On subdomains: when a CNAME comes, remove all previous records and replace with CNAME.
 			if qtype == dns.TypeCNAME {
 				// Keep the values in cache to rollback in case of error during register the CNAME
 				// FIXME: register the value in a backup before delete it to recover them in the case of the PUT fail
-				b.Delete([]byte(domain + ".|" + dns.TypeToString[dns.TypeA]))
-				b.Delete([]byte(domain + ".|" + dns.TypeToString[dns.TypeAAAA]))
-				b.Delete([]byte(domain + ".|" + dns.TypeToString[dns.TypeTXT]))
-				b.Delete([]byte(domain + ".|" + dns.TypeToString[dns.TypePTR]))
-				b.Delete([]byte(domain + ".|" + dns.TypeToString[dns.TypeMX]))
+				for _, k := range keysOfTheName(b, domain) {
+					if _, t := utils.ExtractQnameAndQtypeFromKey(k); t != dns.TypeCNAME {
+						deleted = append(deleted, rrsInBucket(b, k)...)
+
+						if err := deleteRRset(tx, k); err != nil {
+							return err
+						}
+					}
+				}
 				//FIXME update the nb of record in the metrics
 			}
 		}
 
-		err := b.Put(key, rrsRaw)
+		deleted = append(deleted, rrsInBucket(b, key)...)
+		err := putRRset(tx, key, rrsRaw)
 
 		if err != nil {
 			return err
 		}
 
-		return nil
+		return c.recordChangeInJournal(tx, domain, qtype, deleted, rrs)
 	})
 
+	if err != nil {
+		return err
+	}
+
+	// The SOA of the zone apex is changed with the record
+	changedNames := []string{domain}
+	zone, found := utils.FindZone(dns.Fqdn(domain), c.zones)
+
+	if found {
+		changedNames = append(changedNames, zone)
+	}
+
+	if err = c.zoneCache.Refresh(c.db, changedNames...); err != nil {
+		log.WithField("domain", domain).WithError(err).Error("Can't refresh the zone cache")
+	}
+
+	c.responseCache.Invalidate(changedNames...)
+
+	if found {
+		c.notifier.ZoneChanged(zone)
+	}
+
 	log.WithField("rr", utils.RRsIntoString(rrs)).Infof("Saved a new record in DB")
-	return err
+	return nil
+}
+
+// recordChangeInJournal keep the RRs deleted and added in the history of the zone, for the IXFR.
+// Each change is a new version of the zone: the serial of its SOA is bumped according to the serial policy.
+func (c *KafkaConsumer) recordChangeInJournal(tx *bolt.Tx, domain string, qtype uint16, deleted, added []dns.RR) error {
+	zone, found := utils.FindZone(dns.Fqdn(domain), c.zones)
+
+	if !found {
+		return nil
+	}
+
+	if qtype == dns.TypeSOA && utils.ToLowerFQDN(domain) == zone {
+		return c.recordProducedSOA(tx, zone, firstSOA(deleted), firstSOA(added))
+	}
+
+	deleted, added = diffRRs(deleted, added)
+
+	if len(deleted) == 0 && len(added) == 0 {
+		return nil
+	}
+
+	soa := readSOA(tx, zone)
+
+	// The zone starts its history from the synthesized SOA
+	if soa == nil {
+		soa = defaultSOA(zone, c.soa)
+	}
+
+	if err := appendChangeToJournal(tx, zone, soa, deleted, added); err != nil {
+		return err
+	}
+
+	newSOA := dns.Copy(soa).(*dns.SOA)
+	newSOA.Serial = nextSerial(soa.Serial, c.soa.SerialPolicy, time.Now())
+
+	if err := writeSOA(tx, newSOA); err != nil {
+		return err
+	}
+
+	return closeJournalVersion(tx, zone, soa, newSOA)
+}
+
+// recordProducedSOA replace the SOA of the zone by the SOA produced in the event source.
+// Its serial is kept only if it's greater than the current one, so the serial of the zone never goes backward.
+func (c *KafkaConsumer) recordProducedSOA(tx *bolt.Tx, zone string, oldSOA, producedSOA *dns.SOA) error {
+	if oldSOA == nil || producedSOA == nil || oldSOA.String() == producedSOA.String() {
+		return nil
+	}
+
+	newSOA := dns.Copy(producedSOA).(*dns.SOA)
+
+	if !serialGreater(newSOA.Serial, oldSOA.Serial) {
+		newSOA.Serial = nextSerial(oldSOA.Serial, c.soa.SerialPolicy, time.Now())
+
+		if err := writeSOA(tx, newSOA); err != nil {
+			return err
+		}
+	}
+
+	return closeJournalVersion(tx, zone, oldSOA, newSOA)
 }
 
 func (c *KafkaConsumer) isCnameOnApexDomain(domain string, qtype uint16) bool {
@@ -280,16 +386,16 @@ func (c *KafkaConsumer) tryUnmarshalRecord(rawRecord []byte) (records []Record,
 // If yes, we print the diff between the two RR
 func (c *KafkaConsumer) logRecordDiffIfTheRecordWasAlreayHere(key []byte, rrs []dns.RR) {
 	var previousRRraw []byte
-	var previousRR []dns.RR
 
 	c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(RecordBucket))
-		previousRRraw = b.Get(key)
+		previousRRraw = append(previousRRraw, b.Get(key)...)
 		return nil
 	})
 
 	if previousRRraw != nil {
-		err := json.Unmarshal(previousRRraw, &previousRR)
+		_, qtype := utils.ExtractQnameAndQtypeFromKey(key)
+		previousRR, err := decodeRRs(previousRRraw, qtype)
 
 		if err == nil {
 			diffContent := false
@@ -324,3 +430,71 @@ func (c *KafkaConsumer) printMetadatas(rrs []Record) {
 		}
 	}
 }
+
+// rrsInBucket return the RRs registered with the key, or an empty slice if they can't be read
+func rrsInBucket(b *bolt.Bucket, key []byte) []dns.RR {
+	raw := b.Get(key)
+
+	if raw == nil {
+		return []dns.RR{}
+	}
+
+	rrs, err := mapPairKeyRawRRsIntoRR(PairKeyRRraw{key: key, rrsRaw: raw})
+
+	if err != nil {
+		log.WithField("key", string(key)).Error(err)
+		return []dns.RR{}
+	}
+
+	return rrs
+}
+
+// keysOfTheName return the keys of all the types registered for the domain
+func keysOfTheName(b *bolt.Bucket, domain string) (keys [][]byte) {
+	prefix := []byte(dns.Fqdn(domain) + "|")
+	c := b.Cursor()
+
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	return
+}
+
+// firstSOA return the first SOA of the RRs or nil if there isn't
+func firstSOA(rrs []dns.RR) *dns.SOA {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+
+	return nil
+}
+
+// diffRRs return the RRs which are only in before and the RRs which are only in after
+func diffRRs(before, after []dns.RR) (deleted, added []dns.RR) {
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		for _, r := range rrs {
+			if r != nil && r.String() == rr.String() {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, rr := range before {
+		if rr != nil && !contains(after, rr) {
+			deleted = append(deleted, rr)
+		}
+	}
+
+	for _, rr := range after {
+		if rr != nil && !contains(before, rr) {
+			added = append(added, rr)
+		}
+	}
+
+	return
+}
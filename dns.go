@@ -2,9 +2,10 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
+	"net"
 	a "stream-dns/agent"
+	ms "stream-dns/metrics"
 	"stream-dns/utils"
 	"time"
 
@@ -20,6 +21,8 @@ const (
 	TypicalResponseTime = 100 * time.Millisecond
 	MaxRecursion        = 5
 	MaxNameservers      = 4
+	// Default EDNS0 UDP payload size, which avoids IP fragmentation. c.f DNS flag day 2020
+	DefaultMaxUdpSize = 1232
 )
 
 // Resolver errors.
@@ -41,19 +44,132 @@ type PairKeyRRraw struct {
 // QuestionResolverHandler handler to answer to DNS question
 type QuestionResolverHandler struct {
 	db             *bolt.DB
+	zoneCache      *ZoneCache     // (optional) RRsets of the DB in memory, the DB is read when it's nil
+	responseCache  *ResponseCache // (optional) packed authoritative responses
 	config         DnsConfig
 	metricsService *a.MetricsService
-	resolver       *Resolver
+	resolver       RecursiveResolver
+	forwardZones   []ForwardZone // conditional forwarding rules, the most specific zone first
+	recursionMode  string
+	recursionACL   []*net.IPNet
+	rateLimiter    *RateLimiter         // nil when the response rate limiting is disabled
+	admission      *AdmissionController // nil when there is no admission control
+	signer         *DnssecSigner
+	xfrACL         []*net.IPNet
+	tsigKeys       map[string]TsigKey
+	aliases        *aliasCache // addresses of the targets of the ALIAS out of our zones
+}
+
+// ParseMaxUdpSize check the size of the configuration, 0 when it isn't set, before it's kept on 16 bits
+func ParseMaxUdpSize(size int) (uint16, error) {
+	if size != 0 && (size < dns.MinMsgSize || size > dns.MaxMsgSize) {
+		return 0, fmt.Errorf("invalid maximum UDP size %d, must be between %d and %d bytes", size, dns.MinMsgSize, dns.MaxMsgSize)
+	}
+
+	return uint16(size), nil
 }
 
 // NewQuestionResolverHandler create a new QuestionResolverHandler
-func NewQuestionResolverHandler(db *bolt.DB, config DnsConfig, ms *a.MetricsService) QuestionResolverHandler {
-	return QuestionResolverHandler{
+func NewQuestionResolverHandler(db *bolt.DB, zoneCache *ZoneCache, responseCache *ResponseCache, config DnsConfig, ms *a.MetricsService) QuestionResolverHandler {
+	if config.MaxUdpSize < dns.MinMsgSize {
+		config.MaxUdpSize = DefaultMaxUdpSize
+	}
+
+	handler := QuestionResolverHandler{
 		db:             db,
+		zoneCache:      zoneCache,
+		responseCache:  responseCache,
 		config:         config,
 		metricsService: ms,
 		resolver:       NewResolver(), //TODO: make timeout configurable
+		aliases:        newAliasCache(),
+	}
+
+	if config.Dnssec.KeysDir != "" {
+		signer, err := NewDnssecSigner(config.Dnssec.KeysDir, config.Zones, config.Dnssec.SignatureValidity)
+
+		if err != nil {
+			log.WithField("keys-dir", config.Dnssec.KeysDir).Panic(err)
+		}
+
+		handler.signer = signer
+	}
+
+	xfrAllowedIPs := config.Xfr.AllowedIPs
+
+	if len(xfrAllowedIPs) == 0 {
+		xfrAllowedIPs = DefaultAllowedIPs
+	}
+
+	xfrACL, err := utils.ParseCIDRs(xfrAllowedIPs)
+
+	if err != nil {
+		log.WithField("allowed-ips", xfrAllowedIPs).Panic(err)
+	}
+
+	handler.xfrACL = xfrACL
+
+	if handler.recursionMode, err = ParseRecursionMode(config.Recursion.Mode); err != nil {
+		log.Panic(err)
 	}
+
+	recursionAllowedIPs := config.Recursion.AllowedIPs
+
+	if len(recursionAllowedIPs) == 0 {
+		recursionAllowedIPs = DefaultAllowedIPs
+	}
+
+	if handler.recursionACL, err = utils.ParseCIDRs(recursionAllowedIPs); err != nil {
+		log.WithField("allowed-ips", recursionAllowedIPs).Panic(err)
+	}
+
+	if handler.rateLimiter, err = NewRateLimiter(config.Rrl); err != nil {
+		log.WithField("exempt-ips", config.Rrl.ExemptIPs).Panic(err)
+	}
+
+	if handler.admission, err = NewAdmissionController(config.Admission); err != nil {
+		log.Panic(err)
+	}
+
+	tsigKeys, err := ParseTsigKeys(config.TsigKeys)
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, name := range config.Xfr.TsigKeys {
+		if _, found := tsigKeys[utils.ToLowerFQDN(name)]; !found {
+			log.WithField("key", name).Panic("The TSIG key allowed to transfer the zones isn't in the keyring")
+		}
+	}
+
+	handler.tsigKeys = tsigKeys
+
+	// The queries out of our zones are forwarded when upstreams are configured, otherwise they're resolved from the root
+	if len(config.Forward.Upstreams) > 0 {
+		forwarder, err := NewForwarder(config.Forward, ms)
+
+		if err != nil {
+			log.WithField("upstreams", config.Forward.Upstreams).Panic(err)
+		}
+
+		forwarder.StartHealthChecks()
+		handler.resolver = forwarder
+	}
+
+	forwardZones, err := ParseForwardZones(config.Forward, ms)
+
+	if err != nil {
+		log.WithField("forward-zones", config.Forward.Zones).Panic(err)
+	}
+
+	for _, forwardZone := range forwardZones {
+		forwardZone.Forwarder.StartHealthChecks()
+	}
+
+	handler.forwardZones = forwardZones
+
+	return handler
 }
 
 // ServeDNS is the handler registered in the dns.Server.Handler
@@ -61,14 +177,78 @@ func (h *QuestionResolverHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	requestID := uuid.New().String()
 	remoteAddr := w.RemoteAddr().String()
 
+	if rcode, reason := validateQuery(r); rcode != dns.RcodeSuccess {
+		log.WithFields(log.Fields{
+			"ip":         remoteAddr,
+			"request-id": requestID,
+			"opcode":     dns.OpcodeToString[r.Opcode],
+			"reason":     reason,
+		}).Warn("Rejected a DNS query")
+
+		h.incMetric(reason)
+		h.writeRcode(w, r, rcode)
+		return
+	}
+
+	if tsigError := h.checkTsig(w, r); tsigError != dns.RcodeSuccess {
+		log.WithFields(log.Fields{
+			"ip":         remoteAddr,
+			"request-id": requestID,
+			"key":        r.IsTsig().Hdr.Name,
+			"tsig-error": dns.RcodeToString[int(tsigError)],
+		}).Warn("Rejected a DNS query with an invalid TSIG")
+
+		h.incMetric(RejectInvalidTsig)
+		writeTsigError(w, r, tsigError)
+		return
+	}
+
+	if qtype := r.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		h.serveZoneTransfer(w, r, requestID)
+		return
+	}
+
 	var rcode int
 	msg := dns.Msg{}
 	msg.SetReply(r)
-	question := msg.Question[0] // we only support one question
+	// We only support one question. The names are looked up in lowercase, the response keeps the case
+	// of the question, which some resolvers randomize to protect themselves from spoofing. c.f draft-vixie-dnsext-dns0x20
+	question := msg.Question[0]
+	question.Name = utils.ToLowerFQDN(question.Name)
+
+	// The DNSSEC OK bit of the EDNS0 OPT RR asks for the RRSIGs. c.f RFC 3225
+	opt := r.IsEdns0()
+	dnssecOK := opt != nil && opt.Do()
+
+	// We only support the version 0 of EDNS. c.f RFC 6891
+	if opt != nil && opt.Version() != 0 {
+		msg.SetEdns0(h.config.MaxUdpSize, false)
+		msg.SetRcode(r, dns.RcodeBadVers)
+		signResponse(r, &msg)
+		w.WriteMsg(&msg)
+		return
+	}
+
+	// The recursion is only available to the allowed clients, the others can't ask the names out of our zones.
+	recursion := h.recursionAllowed(w.RemoteAddr())
+	msg.RecursionAvailable = recursion
 
-	if h.isALocalRecord(dns.Fqdn(question.Name)) {
+	if !h.queryAllowed(question.Name, recursion) {
+		log.WithFields(log.Fields{
+			"ip":         remoteAddr,
+			"request-id": requestID,
+			"domain":     question.Name,
+		}).Warn("Refused a recursive DNS query")
+
+		h.incMetric(RejectRecursion)
+		msg.SetRcode(r, dns.RcodeRefused)
+		signResponse(r, &msg)
+		w.WriteMsg(&msg)
+		return
+	}
+
+	if h.isALocalRecord(question.Name) {
 		msg.Authoritative = true
-		msg.RecursionAvailable = true
 	}
 
 	log.WithFields(log.Fields{
@@ -79,7 +259,86 @@ func (h *QuestionResolverHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		"qclass":     dns.ClassToString[question.Qclass],
 	}).Info("Got a new DNS question")
 
-	rcode, answers := h.resolveQuestion(question, msg.RecursionDesired)
+	// Only the authoritative responses are cached, the resolver has its own cache, and the responses
+	// to the signed queries are never the same because of their TSIG.
+	var cacheKey string
+	var cacheGeneration uint64
+
+	if h.responseCache != nil && msg.Authoritative && r.IsTsig() == nil {
+		cacheKey = responseCacheKey(r, recursion, opt != nil, dnssecOK, h.maxResponseSize(w, opt))
+		cacheGeneration = h.responseCache.Generation()
+
+		if raw := h.responseCache.Get(cacheKey, r); raw != nil {
+			// The rcode is the last 4 bits of the flags of the header
+			if h.rateLimited(w, r, int(raw[3]&0xF)) {
+				return
+			}
+
+			if _, err := w.Write(raw); err != nil {
+				log.WithFields(log.Fields{"ip": remoteAddr, "request-id": requestID}).Error(err)
+			}
+
+			return
+		}
+	}
+
+	// The names below a zone cut aren't authoritative data, the client is referred to the child zone
+	if cut := h.zoneCut(question.Name, question.Qtype); cut != "" {
+		rcode = h.referral(&msg, cut, dnssecOK)
+	} else {
+		rcode = h.answer(&msg, question, recursion, dnssecOK, remoteAddr, requestID)
+		h.addAdditional(&msg, dnssecOK, opt != nil, h.maxResponseSize(w, opt))
+	}
+
+	if opt != nil {
+		msg.SetEdns0(h.config.MaxUdpSize, dnssecOK)
+	}
+
+	msg.SetRcode(r, rcode)
+
+	if h.rateLimited(w, r, rcode) {
+		return
+	}
+
+	// Remove the RRs which don't fit in the response and set the TC flag,
+	// so the client knows it has to retry over TCP.
+	msg.Truncate(h.maxResponseSize(w, opt))
+	signResponse(r, &msg)
+	var err error
+
+	if cacheKey != "" && rcode != dns.RcodeServerFailure && h.isALocalAnswer(&msg) {
+		var raw []byte
+
+		if raw, err = msg.Pack(); err == nil {
+			h.responseCache.Set(cacheKey, raw, h.responseDependencies(question.Name, &msg), responseMaxAge(&msg), cacheGeneration)
+			_, err = w.Write(raw)
+		}
+	} else {
+		err = w.WriteMsg(&msg)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"ip":         w.RemoteAddr,
+			"request-id": requestID,
+			"domain":     question.Name,
+			"qtype":      dns.TypeToString[question.Qtype],
+			"qclass":     dns.ClassToString[question.Qclass],
+		}).Error(err)
+	}
+}
+
+// answer fill the response with the RRs of the question, and the SOA of the zone for a negative answer
+func (h *QuestionResolverHandler) answer(msg *dns.Msg, question dns.Question, recursion bool, dnssecOK bool, remoteAddr string, requestID string) (rcode int) {
+	var answers []dns.RR
+
+	// The response of an upstream is kept as is, so a NODATA isn't turned into a NXDOMAIN
+	if forwarder, ok := h.resolverOf(question.Name).(*Forwarder); ok && !h.isALocalRecord(question.Name) {
+		return h.forward(msg, forwarder, question, remoteAddr, requestID)
+	}
+
+	// A client which isn't allowed to recurse gets the CNAME without its target, which could be out of our zones
+	rcode, answers = h.resolveQuestion(question, msg.RecursionDesired && recursion)
 
 	// copy all RRs which match QTYPE or CNAME into the answer.
 	// If a match would take us out of the authoritative data,
@@ -109,26 +368,101 @@ func (h *QuestionResolverHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	// May optionally carry the SOA RR for the authoritative data in the answer section. c.f RFC 1034
 	if len(msg.Answer) == 0 && h.isALocalRecord(question.Name) {
 		msg.Authoritative = true
-		zone := utils.GetZoneFromQname(question.Name)
+		zone := h.zoneOf(question.Name)
 		soa := h.getSOAForTheZone(zone)
 
 		if soa != nil {
 			msg.Ns = append(msg.Ns, soa)
 		}
+
+		// Authenticated denial of existence for the negative answers of a signed zone. c.f RFC 4035
+		if dnssecOK && (rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError) {
+			if zoneSigner := h.signer.ZoneSigner(question.Name); zoneSigner != nil {
+				nsec := zoneSigner.DenialOfExistence(question.Name, h.answeredTypes(question.Name), negativeTTL(soa))
+				msg.Ns = append(msg.Ns, nsec)
+				// The NSEC proves that the name exists, without the types asked.
+				rcode = dns.RcodeSuccess
+			}
+		}
 	}
 
-	msg.SetRcode(r, rcode)
-	err := w.WriteMsg(&msg)
+	if dnssecOK && h.signer != nil {
+		msg.Answer = h.signer.Sign(msg.Answer)
+		msg.Ns = h.signer.Sign(msg.Ns)
+	}
+
+	return
+}
+
+// forward fill the response with the answer and authority sections of the upstream, and return its rcode.
+// The authority section of a negative answer has the SOA of the zone for the negative caching. c.f RFC 2308
+func (h *QuestionResolverHandler) forward(msg *dns.Msg, forwarder *Forwarder, question dns.Question, remoteAddr string, requestID string) int {
+	r, err := forwarder.Exchange(question.Name, question.Qtype)
 
 	if err != nil {
-		log.WithFields(log.Fields{
-			"ip":         w.RemoteAddr,
-			"request-id": requestID,
-			"domain":     question.Name,
-			"qtype":      dns.TypeToString[question.Qtype],
-			"qclass":     dns.ClassToString[question.Qclass],
-		}).Error(err)
+		log.WithFields(log.Fields{"ip": remoteAddr, "request-id": requestID, "domain": question.Name}).Error(err)
+		return dns.RcodeServerFailure
+	}
+
+	msg.Answer = r.Answer
+	msg.Ns = r.Ns
+
+	log.WithFields(log.Fields{
+		"ip":         remoteAddr,
+		"request-id": requestID,
+		"domain":     question.Name,
+		"qtype":      dns.TypeToString[question.Qtype],
+		"rcode":      dns.RcodeToString[r.Rcode],
+		"answers":    msg.Answer,
+	}).Info("Forwarded the question")
+
+	return r.Rcode
+}
+
+// writeRcode answer to the request with an empty response which has only the rcode
+func (h *QuestionResolverHandler) writeRcode(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	msg := dns.Msg{}
+	msg.SetRcode(r, rcode)
+
+	if h.checkTsig(w, r) == dns.RcodeSuccess {
+		signResponse(r, &msg)
+	}
+
+	if err := w.WriteMsg(&msg); err != nil {
+		log.WithField("ip", w.RemoteAddr().String()).Error(err)
+	}
+}
+
+// incMetric increment the counter metricName. The handler can be used without metrics service in the tests.
+func (h *QuestionResolverHandler) incMetric(metricName string) {
+	if h.metricsService != nil {
+		h.metricsService.GetOrCreateAggregator(metricName, ms.Counter, false).(a.AggregatorCounter).Inc(1)
+	}
+}
+
+// maxResponseSize return the size in bytes allowed for the response.
+// Over TCP, a message can be up to 64KiB. Over UDP, it's the buffer size advertised by the client
+// in its OPT RR, bounded by our own maximum, or 512 bytes without EDNS0.
+func (h *QuestionResolverHandler) maxResponseSize(w dns.ResponseWriter, opt *dns.OPT) int {
+	if isTCP(w) {
+		return dns.MaxMsgSize
 	}
+
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+
+	return utils.Min(utils.Max(int(opt.UDPSize()), dns.MinMsgSize), int(h.config.MaxUdpSize))
+}
+
+// isTCP look if the client is connected with TCP, or with QUIC which has the same streams
+func isTCP(w dns.ResponseWriter) bool {
+	if _, isQUIC := w.(*doqResponseWriter); isQUIC {
+		return true
+	}
+
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	return isTCP
 }
 
 // Main point to resolve a question
@@ -141,13 +475,14 @@ func (h *QuestionResolverHandler) resolveQuestion(question dns.Question, recursi
 
 	if err != nil {
 		rcode = dns.RcodeServerFailure
-	}
-
-	if len(rrs) == 0 {
+	} else if len(rrs) == 0 {
 		rcode = dns.RcodeNameError
-	}
 
-	//TODO: truncate the response if the payload (rrs) is over 512 bytes and set the TC header flag.
+		// The name exists with other types, it's a NODATA response. c.f RFC 2308
+		if h.isALocalRecord(question.Name) && h.nameExists(question.Name) {
+			rcode = dns.RcodeSuccess
+		}
+	}
 
 	return
 }
@@ -162,9 +497,9 @@ func (h *QuestionResolverHandler) lookupRecord(qname string, qtype uint16, recur
 	}
 
 	if h.isALocalRecord(qname) {
-		rrs, err = h.lookupRecordInLocalDB(qname, qtype)
+		rrs, err = h.lookupRecordInLocalDB(qname, qtype, depth)
 	} else {
-		rrs = h.resolver.Resolve(qname, qtype)
+		rrs, err = h.resolverOf(qname).Resolve(qname, qtype)
 	}
 
 	// Change the wildcard canonical name for the owner, the qname of the last record.
@@ -194,31 +529,79 @@ func (h *QuestionResolverHandler) lookupRecord(qname string, qtype uint16, recur
 }
 
 // lookupRecordInLocalDB look for a record in the local db and map the raw result into a RRs result
-func (h *QuestionResolverHandler) lookupRecordInLocalDB(qname string, qtype uint16) (rrs []dns.RR, err error) {
-	rawRRs, err := h.selectRawRecordInLocalDb([]byte(dns.Fqdn(qname)))
-	rrs, err = mapPairKeyRawRRsIntoRR(rawRRs)
+func (h *QuestionResolverHandler) lookupRecordInLocalDB(qname string, qtype uint16, depth int) (rrs []dns.RR, err error) {
+	// The DNSKEY RRset of a signed zone isn't in the DB, it comes from the keys loaded by the signer.
+	if qtype == dns.TypeDNSKEY {
+		if zoneSigner := h.signer.ZoneSigner(qname); zoneSigner != nil && zoneSigner.Zone() == utils.ToLowerFQDN(qname) {
+			return zoneSigner.DNSKEYs(), nil
+		}
+	}
+
+	// The RRs below a zone cut, like the glue, aren't authoritative data
+	if h.zoneCut(qname, qtype) != "" {
+		return []dns.RR{}, nil
+	}
 
-	if len(rrs) == 0 {
+	rrs, err = h.selectRRsInLocalDb(dns.Fqdn(qname), qtype)
+
+	// The apex of a zone without SOA answers with the synthesized one, the secondaries poll its serial
+	if len(rrs) == 0 && err == nil && qtype == dns.TypeSOA && h.zoneOf(qname) == utils.ToLowerFQDN(qname) {
+		if soa := h.getSOAForTheZone(qname); soa != nil {
+			return []dns.RR{soa}, nil
+		}
+	}
+
+	// The addresses of a name with an ALIAS are the addresses of its target
+	if len(rrs) == 0 && err == nil && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		if aliases := h.localRRset(qname, TypeALIAS); len(aliases) > 0 {
+			return h.flattenAlias(dns.Fqdn(qname), qtype, aliases[0], depth)
+		}
+	}
+
+	if len(rrs) == 0 && err == nil {
 		// If at some label, a match is impossible (i.e., the
 		// corresponding label does not exist), look to see if a
-		// the "*" label exists.
-		wildcardQname := utils.IntoWildcardQname(dns.Fqdn(qname))
-		rawRRs, err = h.selectRawRecordInLocalDb([]byte(wildcardQname))
-		rrs, err = mapPairKeyRawRRsIntoRR(rawRRs)
+		// the "*" label exists under the closest encloser.
+		if source, found := h.wildcardSource(qname); found {
+			rrs, err = h.selectRRsInLocalDb(source, qtype)
+		}
 	}
 
 	return
 }
 
+// selectRRsInLocalDb return the RRset of type qtype owned by the qname,
+// or its CNAME if the qname is an alias.
+func (h *QuestionResolverHandler) selectRRsInLocalDb(qname string, qtype uint16) ([]dns.RR, error) {
+	if h.zoneCache != nil {
+		if rrs := h.zoneCache.RRset(qname, qtype); rrs != nil || qtype == dns.TypeCNAME {
+			return rrs, nil
+		}
+
+		return h.zoneCache.RRset(qname, dns.TypeCNAME), nil
+	}
+
+	rawRRs, err := h.selectRawRecordInLocalDb(utils.Key(qname, qtype))
+
+	if err == nil && rawRRs.key == nil && qtype != dns.TypeCNAME {
+		rawRRs, err = h.selectRawRecordInLocalDb(utils.Key(qname, dns.TypeCNAME))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mapPairKeyRawRRsIntoRR(rawRRs)
+}
+
 // selectRawRecordInLocalDb find a record in the bbolt DB and return a raw result
-func (h *QuestionResolverHandler) selectRawRecordInLocalDb(prefix []byte) (rawRecords PairKeyRRraw, err error) {
+func (h *QuestionResolverHandler) selectRawRecordInLocalDb(key []byte) (rawRecords PairKeyRRraw, err error) {
 	err = h.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(RecordBucket)
 
-		c := bucket.Cursor()
-
-		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			rawRecords = PairKeyRRraw{key: k, rrsRaw: v}
+		// The value is only valid during the transaction, so we keep a copy.
+		if v := bucket.Get(key); v != nil {
+			rawRecords = PairKeyRRraw{key: key, rrsRaw: append([]byte{}, v...)}
 		}
 
 		return nil
@@ -227,38 +610,48 @@ func (h *QuestionResolverHandler) selectRawRecordInLocalDb(prefix []byte) (rawRe
 	return
 }
 
+// nameExists look if the qname owns at least one record, directly or through a wildcard,
+// or if it's an empty non-terminal
+func (h *QuestionResolverHandler) nameExists(qname string) bool {
+	if h.nameExistsInZone(qname) {
+		return true
+	}
+
+	_, found := h.wildcardSource(qname)
+	return found
+}
+
 // Check if the Qname of a question is a local record related to the managed zones set in the config
 func (h *QuestionResolverHandler) isALocalRecord(qname string) (isLocal bool) {
 	return utils.IsALocalRR(qname, h.config.Zones)
 }
 
-// getSOAForTheZone return the SOA for a specific zone
-// The Authority section of the response may optionally carry the
-// SOA RR for the authoritative data in the answer section.
-func (h *QuestionResolverHandler) getSOAForTheZone(zone string) (soa dns.RR) {
-	log.Debug("looking for the SOA of an authority zone", zone)
+// isALocalAnswer look if all the RRs of the answer are local, a CNAME can lead out of the managed zones
+func (h *QuestionResolverHandler) isALocalAnswer(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		if !h.isALocalRecord(rr.Header().Name) {
+			return false
+		}
+	}
 
-	h.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(RecordBucket)
-		soaRaw := bucket.Get(utils.Key(zone, dns.TypeSOA))
+	return true
+}
 
-		if soaRaw != nil {
-			var soatmp []dns.SOA
-			err := json.Unmarshal(soaRaw, &soatmp)
+// typesAtName return the types of the records owned by the qname in the local DB
+func (h *QuestionResolverHandler) typesAtName(qname string) (types []uint16) {
+	if h.zoneCache != nil {
+		return h.zoneCache.Types(qname)
+	}
 
-			if err != nil {
-				log.WithField("zone", zone).Error(err)
-				return nil
-			}
+	prefix := []byte(dns.Fqdn(qname) + "|")
 
-			soa, err = dns.NewRR(soatmp[0].String())
+	h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(RecordBucket).Cursor()
 
-			if err != nil {
-				log.WithField("zone", zone).Error(err)
-				return nil
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if qtype, found := utils.StringToType(string(k[len(prefix):])); found {
+				types = append(types, qtype)
 			}
-		} else {
-			log.WithField("zone", zone).Debug("can't found SOA")
 		}
 
 		return nil
@@ -267,136 +660,80 @@ func (h *QuestionResolverHandler) getSOAForTheZone(zone string) (soa dns.RR) {
 	return
 }
 
-// smapPairKeyRawRRsIntoRR serialize a slice of RR get from bbolt into a dns.RR slice.
-// Yeah Go doesn't need generics...
-// FIXME: when go support generic, you can refactore this method. This is due to the method json.Unmarshal which doesn't support
-// unmarshaling of interface like dns.RR. So we have to create a concrete type (ex dns.A) and convert it into dns.RR at the end.
-// But yeah Go doesn't need generic and copy/paste is a good practice.
-func mapPairKeyRawRRsIntoRR(pair PairKeyRRraw) (rrs []dns.RR, err error) {
-	if pair.key == nil || pair.rrsRaw == nil {
-		return []dns.RR{}, nil
+// answeredTypes return the types answered at the qname: the types of its records,
+// or the types of the wildcard which synthesizes its answers
+func (h *QuestionResolverHandler) answeredTypes(qname string) []uint16 {
+	if types := h.typesAtName(qname); len(types) > 0 {
+		return types
 	}
 
-	qname, qtype := utils.ExtractQnameAndQtypeFromKey(pair.key)
-
-	switch qtype {
-	case dns.TypeA:
-		var tmp []dns.A
-		err = json.Unmarshal(pair.rrsRaw, &tmp)
-
-		if err != nil {
-			return
-		}
+	if source, found := h.wildcardSource(qname); found {
+		return h.typesAtName(source)
+	}
 
-		for _, val := range tmp {
-			rr, err := dns.NewRR(val.String())
-			if err != nil {
-				return nil, err
-			}
-			rrs = append(rrs, rr)
-		}
-		break
-	case dns.TypeAAAA:
-		var tmp []dns.AAAA
-		err = json.Unmarshal(pair.rrsRaw, &tmp)
+	return nil
+}
 
-		if err != nil {
-			return
-		}
+// zoneOf return the apex of the managed zone of the qname
+func (h *QuestionResolverHandler) zoneOf(qname string) string {
+	zone, _ := utils.FindZone(dns.Fqdn(qname), h.config.Zones)
+	return zone
+}
 
-		for _, val := range tmp {
-			rr, err := dns.NewRR(val.String())
-			if err != nil {
-				return nil, err
-			}
-			rrs = append(rrs, rr)
-		}
-		break
-	case dns.TypeCNAME:
-		var tmp []dns.CNAME
-		err = json.Unmarshal(pair.rrsRaw, &tmp)
+// getSOAForTheZone return the SOA for a specific zone
+// The Authority section of the response may optionally carry the
+// SOA RR for the authoritative data in the answer section.
+// A zone of the configuration without SOA gets a synthesized one.
+func (h *QuestionResolverHandler) getSOAForTheZone(zone string) dns.RR {
+	log.Debug("looking for the SOA of an authority zone", zone)
 
-		if err != nil {
-			return
-		}
+	var soa *dns.SOA
 
-		for _, val := range tmp {
-			rr, err := dns.NewRR(val.String())
-			if err != nil {
-				return nil, err
-			}
-			rrs = append(rrs, rr)
-		}
-		break
-	case dns.TypeTXT:
-		var tmp []dns.TXT
-		err = json.Unmarshal(pair.rrsRaw, &tmp)
+	if h.zoneCache != nil {
+		soa = firstSOA(h.zoneCache.RRset(zone, dns.TypeSOA))
+	} else {
+		h.db.View(func(tx *bolt.Tx) error {
+			soa = readSOA(tx, zone)
+			return nil
+		})
+	}
 
-		if err != nil {
-			return
-		}
+	if soa != nil {
+		return soa
+	}
 
-		for _, val := range tmp {
-			rr, err := dns.NewRR(val.String())
-			if err != nil {
-				return nil, err
-			}
-			rrs = append(rrs, rr)
-		}
-		break
-	case dns.TypeSOA:
-		var tmp []dns.SOA
-		err = json.Unmarshal(pair.rrsRaw, &tmp)
+	if apex, found := utils.FindZone(zone, h.config.Zones); found && apex == utils.ToLowerFQDN(zone) {
+		log.WithField("zone", zone).Debug("can't found SOA, synthesize the default one")
+		return defaultSOA(apex, h.config.Soa)
+	}
 
-		if err != nil {
-			return
-		}
+	return nil
+}
 
-		for _, val := range tmp {
-			rr, err := dns.NewRR(val.String())
-			if err != nil {
-				return nil, err
-			}
-			rrs = append(rrs, rr)
-		}
-		break
-	case dns.TypePTR:
-		var tmp []dns.PTR
-		err = json.Unmarshal(pair.rrsRaw, &tmp)
+// mapPairKeyRawRRsIntoRR deserialize the RRs of a key of the bbolt DB into a dns.RR slice
+func mapPairKeyRawRRsIntoRR(pair PairKeyRRraw) (rrs []dns.RR, err error) {
+	if pair.key == nil || pair.rrsRaw == nil {
+		return []dns.RR{}, nil
+	}
 
-		if err != nil {
-			return
-		}
+	qname, qtype := utils.ExtractQnameAndQtypeFromKey(pair.key)
+	rrs, err = decodeRRs(pair.rrsRaw, qtype)
 
-		for _, val := range tmp {
-			rr, err := dns.NewRR(val.String())
-			if err != nil {
-				return nil, err
-			}
-			rrs = append(rrs, rr)
-		}
-		break
-	case dns.TypeNS:
-		var tmp []dns.NS
-		err = json.Unmarshal(pair.rrsRaw, &tmp)
+	if err != nil {
+		return nil, fmt.Errorf("Can't unmarshall %s: %s", qname, err)
+	}
 
-		if err != nil {
-			return
-		}
+	return
+}
 
-		for _, val := range tmp {
-			rr, err := dns.NewRR(val.String())
-			if err != nil {
-				return nil, err
-			}
-			rrs = append(rrs, rr)
-		}
-		break
-	default:
-		return nil, fmt.Errorf("Can't unmarshall %s, his QTYPE doesn't exist or isn't supported yet", qname)
+// negativeTTL return the TTL of a negative answer: the minimum of the SOA TTL and
+// the SOA MINIMUM field. c.f RFC 2308
+func negativeTTL(soa dns.RR) uint32 {
+	if soa == nil {
+		return 0
 	}
 
-	return
+	return uint32(utils.Min(int(soa.Header().Ttl), int(soa.(*dns.SOA).Minttl)))
 }
 
 // Check if this slice is not the content of a CNAME response after a lookup
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stream-dns/utils"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestDB open a bbolt database in a temporary file, with the RecordBucket seeded with the RRsets:
+// each RRset is stored under the key of its first RR. It panics on error, like testRR.
+// The file is deleted by closeTestDB.
+func newTestDB(rrsets ...[]dns.RR) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(os.TempDir(), uuid.New().String()+".db"), 0600, nil)
+
+	if err != nil {
+		panic(err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(RecordBucket); err != nil {
+			return err
+		}
+
+		for _, rrset := range rrsets {
+			if err := putRRset(tx, utils.Key(rrset[0].Header().Name, rrset[0].Header().Rrtype), testMarshalRR(rrset)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	return db
+}
+
+// closeTestDB close a database of newTestDB and delete its file
+func closeTestDB(db *bolt.DB) {
+	path := db.Path()
+	db.Close()
+	os.Remove(path)
+}
+
+// newTestHandler create a handler for the config over a new test database seeded with the RRsets
+func newTestHandler(config DnsConfig, rrsets ...[]dns.RR) QuestionResolverHandler {
+	return NewQuestionResolverHandler(newTestDB(rrsets...), nil, nil, config, nil)
+}
+
+// testResponseWriter keeps the messages written by the handler
+type testResponseWriter struct {
+	remoteAddr net.Addr
+	msg        *dns.Msg // the last message written
+	msgs       []*dns.Msg
+	tsigStatus error // result of the TSIG verification done by the dns.Server
+}
+
+func newTestUDPResponseWriter() *testResponseWriter {
+	return &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4242}}
+}
+
+func newTestTCPResponseWriter() *testResponseWriter {
+	return &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4242}}
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *testResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	w.msg = new(dns.Msg)
+	return len(b), w.msg.Unpack(b)
+}
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+type ServeDNSTestSuite struct {
+	suite.Suite
+	handler QuestionResolverHandler
+}
+
+func (suite *ServeDNSTestSuite) SetupTest() {
+	suite.handler = newTestHandler(DnsConfig{Zones: []string{"internal."}})
+}
+
+func (suite *ServeDNSTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *ServeDNSTestSuite) seed(key string, rrs []dns.RR) {
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		return putRRset(tx, []byte(key), testMarshalRR(rrs))
+	})
+}
+
+// seedLargeRRset register 40 A records for foo.internal., which doesn't fit in 512 bytes
+func (suite *ServeDNSTestSuite) seedLargeRRset() {
+	rrs := []dns.RR{}
+
+	for i := 0; i < 40; i++ {
+		rrs = append(rrs, testRR(fmt.Sprintf("foo.internal. 2700 IN A 10.0.0.%d", i)))
+	}
+
+	suite.seed("foo.internal.|A", rrs)
+}
+
+func (suite *ServeDNSTestSuite) TestShouldTruncateAnUDPResponseWithoutEDNS0() {
+	suite.seedLargeRRset()
+	w := newTestUDPResponseWriter()
+	r := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+
+	suite.handler.ServeDNS(w, r)
+
+	suite.True(w.msg.Truncated)
+	suite.True(w.msg.Len() <= dns.MinMsgSize)
+	suite.Nil(w.msg.IsEdns0())
+}
+
+func (suite *ServeDNSTestSuite) TestShouldUseTheBufferSizeAdvertisedWithEDNS0() {
+	suite.seedLargeRRset()
+	w := newTestUDPResponseWriter()
+	r := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+	r.SetEdns0(4096, false)
+
+	suite.handler.ServeDNS(w, r)
+
+	suite.False(w.msg.Truncated)
+	suite.Equal(40, len(w.msg.Answer))
+	suite.NotNil(w.msg.IsEdns0())
+	suite.Equal(uint16(DefaultMaxUdpSize), w.msg.IsEdns0().UDPSize())
+}
+
+func (suite *ServeDNSTestSuite) TestShouldNotTruncateOverTCP() {
+	suite.seedLargeRRset()
+	w := newTestTCPResponseWriter()
+	r := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+
+	suite.handler.ServeDNS(w, r)
+
+	suite.False(w.msg.Truncated)
+	suite.Equal(40, len(w.msg.Answer))
+}
+
+func (suite *ServeDNSTestSuite) TestShouldAnswerBadVersForAnUnknownEDNSVersion() {
+	w := newTestUDPResponseWriter()
+	r := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	r.IsEdns0().SetVersion(1)
+
+	suite.handler.ServeDNS(w, r)
+
+	suite.Equal(dns.RcodeBadVers, w.msg.Rcode)
+}
+
+func (suite *ServeDNSTestSuite) TestShouldRefuseAMaxUdpSizeOutOfTheRange() {
+	for _, size := range []int{0, 512, 4096, 65535} {
+		parsed, err := ParseMaxUdpSize(size)
+		suite.Nil(err)
+		suite.Equal(uint16(size), parsed)
+	}
+
+	for _, size := range []int{-1, 100, 65536, 70000} {
+		_, err := ParseMaxUdpSize(size)
+		suite.NotNil(err, size)
+	}
+}
+
+func (suite *ServeDNSTestSuite) TestShouldRejectMalformedOrUnsupportedQueries() {
+	noQuestion := new(dns.Msg)
+	noQuestion.Id = dns.Id()
+
+	manyQuestions := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+	manyQuestions.Question = append(manyQuestions.Question, dns.Question{Name: "bar.internal.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	update := new(dns.Msg).SetUpdate("internal.")
+
+	notify := new(dns.Msg).SetNotify("internal.")
+
+	chaos := new(dns.Msg).SetQuestion("version.bind.", dns.TypeTXT)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+
+	tests := []struct {
+		query *dns.Msg
+		rcode int
+	}{
+		{noQuestion, dns.RcodeFormatError},
+		{manyQuestions, dns.RcodeFormatError},
+		{update, dns.RcodeNotImplemented},
+		{notify, dns.RcodeNotImplemented},
+		{chaos, dns.RcodeRefused},
+	}
+
+	for _, test := range tests {
+		w := newTestUDPResponseWriter()
+
+		suite.handler.ServeDNS(w, test.query)
+
+		suite.Equal(test.rcode, w.msg.Rcode, test.query.String())
+		suite.Equal(0, len(w.msg.Answer))
+	}
+}
+
+func (suite *ServeDNSTestSuite) TestShouldAnswerNotAuthToAQueryWithAnInvalidTsig() {
+	suite.handler.tsigKeys, _ = ParseTsigKeys([]string{"transfer.internal.:" + testTsigSecret})
+
+	tests := []struct {
+		key        string
+		algorithm  string
+		tsigStatus error
+		tsigError  uint16
+	}{
+		{"unknown.internal.", dns.HmacSHA256, dns.ErrSecret, dns.RcodeBadKey},
+		{"transfer.internal.", dns.HmacSHA1, nil, dns.RcodeBadKey},
+		{"transfer.internal.", dns.HmacSHA256, dns.ErrSig, dns.RcodeBadSig},
+		{"transfer.internal.", dns.HmacSHA256, dns.ErrTime, dns.RcodeBadTime},
+	}
+
+	for _, test := range tests {
+		w := newTestUDPResponseWriter()
+		w.tsigStatus = test.tsigStatus
+		r := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+		r.SetTsig(test.key, test.algorithm, TsigFudge, time.Now().Unix())
+
+		suite.handler.ServeDNS(w, r)
+
+		suite.Equal(dns.RcodeNotAuth, w.msg.Rcode)
+		suite.NotNil(w.msg.IsTsig())
+		suite.Equal(test.tsigError, w.msg.IsTsig().Error)
+	}
+}
+
+func (suite *ServeDNSTestSuite) TestShouldSignTheResponseToASignedQuery() {
+	suite.handler.tsigKeys, _ = ParseTsigKeys([]string{"transfer.internal.:" + testTsigSecret})
+	w := newTestUDPResponseWriter()
+	r := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+	r.SetTsig("transfer.internal.", dns.HmacSHA256, TsigFudge, time.Now().Unix())
+
+	suite.handler.ServeDNS(w, r)
+
+	suite.NotEqual(dns.RcodeNotAuth, w.msg.Rcode)
+	suite.NotNil(w.msg.IsTsig())
+	suite.Equal("transfer.internal.", w.msg.IsTsig().Hdr.Name)
+}
+
+func (suite *ServeDNSTestSuite) TestShouldAnswerAQuestionWhateverItsCase() {
+	suite.seed("www.internal.|A", []dns.RR{testRR("www.internal. 2700 IN A 127.0.0.1")})
+	w := newTestUDPResponseWriter()
+	r := new(dns.Msg).SetQuestion("WWW.Internal.", dns.TypeA)
+
+	suite.handler.ServeDNS(w, r)
+
+	suite.Equal(dns.RcodeSuccess, w.msg.Rcode)
+	suite.True(w.msg.Authoritative)
+	suite.Len(w.msg.Answer, 1)
+	suite.Equal("WWW.Internal.", w.msg.Question[0].Name, "the case of the question is kept")
+}
+
+func (suite *ServeDNSTestSuite) TestShouldListTheTypesOfTheWildcardInTheDenialOfExistence() {
+	suite.handler.signer = &DnssecSigner{zones: map[string]*ZoneSigner{}}
+	suite.handler.signer.AddZoneSigner(testZoneSigner("internal."))
+	suite.seed("*.internal.|A", []dns.RR{testRR("*.internal. 2700 IN A 127.0.0.1")})
+	w := newTestUDPResponseWriter()
+	r := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeAAAA)
+	r.SetEdns0(4096, true)
+
+	suite.handler.ServeDNS(w, r)
+
+	suite.Equal(dns.RcodeSuccess, w.msg.Rcode)
+	suite.Empty(w.msg.Answer)
+
+	for _, rr := range w.msg.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			suite.Equal([]uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}, nsec.TypeBitMap, "the A synthesized from the wildcard isn't denied")
+			return
+		}
+	}
+
+	suite.Fail("the NODATA has no NSEC")
+}
+
+func TestServeDNSTestSuite(t *testing.T) {
+	suite.Run(t, new(ServeDNSTestSuite))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DNSSEC online signing configuration.
+const (
+	DefaultSignatureValidity = 7 * 24 * time.Hour
+	// The inception of a signature is backdated to not be rejected by resolvers with a clock skew.
+	SignatureInceptionOffset = 3 * time.Hour
+	// Above this number of signatures, the cache of a zone is flushed.
+	MaxSignatureCacheSize = 100000
+)
+
+// DnssecKey is a DNSKEY associated with its private key
+type DnssecKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// IsKSK look if the key is a Key Signing Key, i.e. it has the Secure Entry Point flag.
+func (k DnssecKey) IsKSK() bool {
+	return k.dnskey.Flags&dns.SEP != 0
+}
+
+type cachedSignatures struct {
+	rrsigs     []dns.RR
+	expiration time.Time
+}
+
+// ZoneSigner signs on the fly the RRsets of one authoritative zone.
+// The RRSIGs are cached by the content of the RRset, so a record updated
+// by the consumer is signed again at its first query.
+type ZoneSigner struct {
+	zone     string
+	keys     []DnssecKey
+	ksks     []DnssecKey
+	zsks     []DnssecKey
+	validity time.Duration
+	mu       sync.RWMutex
+	cache    map[string]cachedSignatures
+}
+
+// NewZoneSigner create a ZoneSigner for the zone apex with its keys.
+// When the zone has only KSKs (Combined Signing Key), they are also used to sign the zone data.
+func NewZoneSigner(zone string, keys []DnssecKey, validity time.Duration) (*ZoneSigner, error) {
+	z := &ZoneSigner{
+		zone:     utils.ToLowerFQDN(zone),
+		keys:     keys,
+		validity: validity,
+		cache:    map[string]cachedSignatures{},
+	}
+
+	if z.validity <= 0 {
+		z.validity = DefaultSignatureValidity
+	}
+
+	for _, key := range keys {
+		if key.IsKSK() {
+			z.ksks = append(z.ksks, key)
+		} else {
+			z.zsks = append(z.zsks, key)
+		}
+	}
+
+	if len(z.ksks) == 0 && len(z.zsks) == 0 {
+		return nil, fmt.Errorf("no DNSSEC key for the zone %s", zone)
+	}
+
+	if len(z.ksks) == 0 {
+		z.ksks = z.zsks
+	}
+
+	if len(z.zsks) == 0 {
+		z.zsks = z.ksks
+	}
+
+	return z, nil
+}
+
+// Zone return the apex of the signed zone
+func (z *ZoneSigner) Zone() string {
+	return z.zone
+}
+
+// DNSKEYs return the DNSKEY RRset served at the apex of the zone
+func (z *ZoneSigner) DNSKEYs() (rrs []dns.RR) {
+	for _, key := range z.keys {
+		rrs = append(rrs, dns.Copy(key.dnskey))
+	}
+
+	return
+}
+
+// SignRRset return the RRSIGs of a RRset. The DNSKEY RRset is signed by the KSKs,
+// all the others by the ZSKs.
+func (z *ZoneSigner) SignRRset(rrset []dns.RR) ([]dns.RR, error) {
+	now := time.Now()
+	key := rrsetCacheKey(rrset)
+
+	z.mu.RLock()
+	cached, found := z.cache[key]
+	z.mu.RUnlock()
+
+	// Sign again before the signature expires to let resolvers cache it a while
+	if found && now.Add(z.validity/4).Before(cached.expiration) {
+		return cached.rrsigs, nil
+	}
+
+	keys := z.zsks
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		keys = z.ksks
+	}
+
+	inception := now.Add(-SignatureInceptionOffset)
+	expiration := now.Add(z.validity)
+	rrsigs := []dns.RR{}
+
+	for _, k := range keys {
+		rrsig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			Algorithm:  k.dnskey.Algorithm,
+			KeyTag:     k.dnskey.KeyTag(),
+			SignerName: z.zone,
+			Inception:  uint32(inception.Unix()),
+			Expiration: uint32(expiration.Unix()),
+		}
+
+		if err := rrsig.Sign(k.signer, rrset); err != nil {
+			return nil, err
+		}
+
+		rrsigs = append(rrsigs, rrsig)
+	}
+
+	z.mu.Lock()
+	if len(z.cache) >= MaxSignatureCacheSize {
+		z.cache = map[string]cachedSignatures{}
+	}
+	z.cache[key] = cachedSignatures{rrsigs: rrsigs, expiration: expiration}
+	z.mu.Unlock()
+
+	return rrsigs, nil
+}
+
+// DenialOfExistence return the NSEC which proves that the qname doesn't own the RRset asked.
+// We don't walk the zone to find the next owner name. Instead, the NSEC covers only the qname
+// with the next name \000.<qname> (c.f RFC 4470 "minimally covering NSEC") and lists the types
+// answered at the qname. For a name which doesn't exist, the bitmap only has the NSEC and RRSIG types,
+// so the NXDOMAIN becomes a NODATA ("black lies"). That avoid to sign on the fly a second NSEC for the
+// wildcard and prevents zone walking.
+// The bitmap lists the types of the answers, not of the stored records: the A and AAAA of an ALIAS,
+// and the SOA and DNSKEY of the apex, even when the SOA is synthesized.
+func (z *ZoneSigner) DenialOfExistence(qname string, types []uint16, ttl uint32) *dns.NSEC {
+	qname = utils.ToLowerFQDN(qname)
+	bitmap := []uint16{dns.TypeNSEC, dns.TypeRRSIG}
+
+	if qname == z.zone {
+		types = append([]uint16{dns.TypeSOA, dns.TypeDNSKEY}, types...)
+	}
+
+	for _, t := range types {
+		if t == TypeALIAS {
+			bitmap = appendType(appendType(bitmap, dns.TypeA), dns.TypeAAAA)
+		} else if t != dns.TypeDNSKEY || qname == z.zone {
+			bitmap = appendType(bitmap, t)
+		}
+	}
+
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: qname, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + qname,
+		TypeBitMap: bitmap,
+	}
+}
+
+// appendType add the type to the list, unless it's already in it
+func appendType(types []uint16, qtype uint16) []uint16 {
+	if containsType(types, qtype) {
+		return types
+	}
+
+	return append(types, qtype)
+}
+
+// DnssecSigner keeps the signers of all the signed zones
+type DnssecSigner struct {
+	zones map[string]*ZoneSigner
+	apexs []string
+}
+
+// NewDnssecSigner load the keys of the managed zones from the directory keysDir.
+// The keys must be the pairs K<zone>+<algorithm>+<key tag>.key/.private generated by dnssec-keygen.
+func NewDnssecSigner(keysDir string, zones []string, validity time.Duration) (*DnssecSigner, error) {
+	keys, err := loadDnssecKeys(keysDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keysByZone := make(map[string][]DnssecKey)
+
+	for _, key := range keys {
+		zone := utils.ToLowerFQDN(key.dnskey.Header().Name)
+
+		if apex, found := utils.FindZone(zone, zones); !found || apex != zone {
+			log.WithField("zone", zone).Warn("ignore the DNSSEC key of a non-managed zone")
+			continue
+		}
+
+		keysByZone[zone] = append(keysByZone[zone], key)
+	}
+
+	signer := &DnssecSigner{zones: map[string]*ZoneSigner{}}
+
+	for zone, zoneKeys := range keysByZone {
+		zoneSigner, err := NewZoneSigner(zone, zoneKeys, validity)
+
+		if err != nil {
+			return nil, err
+		}
+
+		signer.AddZoneSigner(zoneSigner)
+		log.WithFields(log.Fields{"zone": zone, "keys": len(zoneKeys)}).Info("DNSSEC online signing enabled")
+	}
+
+	return signer, nil
+}
+
+// AddZoneSigner register the signer of a zone
+func (s *DnssecSigner) AddZoneSigner(zoneSigner *ZoneSigner) {
+	s.zones[zoneSigner.zone] = zoneSigner
+	s.apexs = append(s.apexs, zoneSigner.zone)
+}
+
+// ZoneSigner return the signer of the closest signed zone of the qname or nil if the zone isn't signed
+func (s *DnssecSigner) ZoneSigner(qname string) *ZoneSigner {
+	if s == nil {
+		return nil
+	}
+
+	apex, found := utils.FindZone(qname, s.apexs)
+
+	if !found {
+		return nil
+	}
+
+	return s.zones[apex]
+}
+
+// Sign return the RRs followed by the RRSIGs of each RRset which belongs to a signed zone
+func (s *DnssecSigner) Sign(rrs []dns.RR) []dns.RR {
+	signed := rrs
+
+	for _, rrset := range splitIntoRRsets(rrs) {
+		zoneSigner := s.ZoneSigner(rrset[0].Header().Name)
+
+		if zoneSigner == nil {
+			continue
+		}
+
+		rrsigs, err := zoneSigner.SignRRset(rrset)
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"zone":  zoneSigner.zone,
+				"rrset": utils.RRsIntoString(rrset),
+			}).Error(err)
+			continue
+		}
+
+		signed = append(signed, rrsigs...)
+	}
+
+	return signed
+}
+
+// splitIntoRRsets group the RRs by owner name and type, in their order of appearance.
+// The RRSIG and OPT records are ignored.
+func splitIntoRRsets(rrs []dns.RR) (rrsets [][]dns.RR) {
+	index := make(map[string]int)
+
+	for _, rr := range rrs {
+		h := rr.Header()
+
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		key := strings.ToLower(h.Name) + "|" + utils.TypeToString(h.Rrtype)
+
+		if i, found := index[key]; found {
+			rrsets[i] = append(rrsets[i], rr)
+		} else {
+			index[key] = len(rrsets)
+			rrsets = append(rrsets, []dns.RR{rr})
+		}
+	}
+
+	return
+}
+
+// rrsetCacheKey return a key which identify the content of a RRset, whatever the order of its RRs
+func rrsetCacheKey(rrset []dns.RR) string {
+	rrs := make([]string, len(rrset))
+
+	for i, rr := range rrset {
+		rrs[i] = strings.ToLower(rr.String())
+	}
+
+	sort.Strings(rrs)
+
+	return strings.Join(rrs, "\n")
+}
+
+// loadDnssecKeys read all the key pairs in the directory
+func loadDnssecKeys(keysDir string) (keys []DnssecKey, err error) {
+	files, err := filepath.Glob(filepath.Join(keysDir, "K*.key"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		key, err := readDnssecKey(strings.TrimSuffix(file, ".key"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return
+}
+
+// readDnssecKey read the public key <basename>.key and the private key <basename>.private
+func readDnssecKey(basename string) (key DnssecKey, err error) {
+	pubFile, err := os.Open(basename + ".key")
+
+	if err != nil {
+		return
+	}
+	defer pubFile.Close()
+
+	rr, err := dns.ReadRR(pubFile, basename+".key")
+
+	if err != nil {
+		return
+	}
+
+	dnskey, ok := rr.(*dns.DNSKEY)
+
+	if !ok {
+		return key, fmt.Errorf("%s.key doesn't contain a DNSKEY", basename)
+	}
+
+	privFile, err := os.Open(basename + ".private")
+
+	if err != nil {
+		return
+	}
+	defer privFile.Close()
+
+	privkey, err := dnskey.ReadPrivateKey(privFile, basename+".private")
+
+	if err != nil {
+		return
+	}
+
+	signer, ok := privkey.(crypto.Signer)
+
+	if !ok {
+		return key, fmt.Errorf("%s.private isn't a signing key", basename)
+	}
+
+	return DnssecKey{dnskey: dnskey, signer: signer}, nil
+}
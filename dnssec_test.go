@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDnssecKey generate a ECDSA P-256 key for the zone
+func testDnssecKey(zone string, flags uint16) DnssecKey {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	privkey, err := dnskey.Generate(256)
+	if err != nil {
+		panic(err)
+	}
+
+	return DnssecKey{dnskey: dnskey, signer: privkey.(crypto.Signer)}
+}
+
+func testZoneSigner(zone string) *ZoneSigner {
+	zoneSigner, err := NewZoneSigner(zone, []DnssecKey{testDnssecKey(zone, 257), testDnssecKey(zone, 256)}, time.Hour)
+	if err != nil {
+		panic(err)
+	}
+
+	return zoneSigner
+}
+
+func TestShouldSignARRsetWithTheZSK(t *testing.T) {
+	zoneSigner := testZoneSigner("internal.")
+	rrset := []dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1"), testRR("foo.internal. 2700 IN A 127.0.0.2")}
+
+	rrsigs, err := zoneSigner.SignRRset(rrset)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rrsigs))
+	rrsig := rrsigs[0].(*dns.RRSIG)
+	assert.Equal(t, zoneSigner.zsks[0].dnskey.KeyTag(), rrsig.KeyTag)
+	assert.Equal(t, "internal.", rrsig.SignerName)
+	assert.Nil(t, rrsig.Verify(zoneSigner.zsks[0].dnskey, rrset))
+}
+
+func TestShouldSignTheDNSKEYRRsetWithTheKSK(t *testing.T) {
+	zoneSigner := testZoneSigner("internal.")
+
+	rrsigs, err := zoneSigner.SignRRset(zoneSigner.DNSKEYs())
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rrsigs))
+	assert.Equal(t, zoneSigner.ksks[0].dnskey.KeyTag(), rrsigs[0].(*dns.RRSIG).KeyTag)
+}
+
+func TestShouldReuseTheCachedSignatureOfAnUnchangedRRset(t *testing.T) {
+	zoneSigner := testZoneSigner("internal.")
+
+	first, _ := zoneSigner.SignRRset([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1"), testRR("foo.internal. 2700 IN A 127.0.0.2")})
+	second, _ := zoneSigner.SignRRset([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.2"), testRR("foo.internal. 2700 IN A 127.0.0.1")})
+	changed, _ := zoneSigner.SignRRset([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.3")})
+
+	assert.Equal(t, first[0].(*dns.RRSIG).Signature, second[0].(*dns.RRSIG).Signature)
+	assert.NotEqual(t, first[0].(*dns.RRSIG).Signature, changed[0].(*dns.RRSIG).Signature)
+}
+
+func TestShouldOnlySignTheRRsetsOfSignedZones(t *testing.T) {
+	signer := &DnssecSigner{zones: map[string]*ZoneSigner{}}
+	signer.AddZoneSigner(testZoneSigner("internal."))
+
+	rrs := signer.Sign([]dns.RR{
+		testRR("foo.internal. 3600 IN CNAME bar.example.com."),
+		testRR("bar.example.com. 2700 IN A 127.0.0.1"),
+	})
+
+	assert.Equal(t, 3, len(rrs))
+	assert.Equal(t, dns.TypeCNAME, rrs[2].(*dns.RRSIG).TypeCovered)
+}
+
+func TestShouldCoverOnlyTheQnameInTheDenialOfExistence(t *testing.T) {
+	zoneSigner := testZoneSigner("internal.")
+
+	nsec := zoneSigner.DenialOfExistence("foo.internal.", []uint16{dns.TypeA, dns.TypeTXT}, 300)
+
+	assert.Equal(t, "foo.internal.", nsec.Header().Name)
+	assert.Equal(t, "\\000.foo.internal.", nsec.NextDomain)
+	assert.Equal(t, []uint16{dns.TypeA, dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}, nsec.TypeBitMap)
+	assert.Equal(t, uint32(300), nsec.Header().Ttl)
+
+	msg := new(dns.Msg)
+	msg.Ns = []dns.RR{nsec}
+	_, err := msg.Pack()
+	assert.Nil(t, err)
+}
+
+func TestShouldTurnANameErrorIntoANoDataInTheDenialOfExistence(t *testing.T) {
+	zoneSigner := testZoneSigner("internal.")
+
+	nsec := zoneSigner.DenialOfExistence("nowhere.internal.", nil, 300)
+
+	assert.Equal(t, []uint16{dns.TypeRRSIG, dns.TypeNSEC}, nsec.TypeBitMap)
+}
+
+func TestShouldListTheAnsweredTypesInTheDenialOfExistence(t *testing.T) {
+	zoneSigner := testZoneSigner("internal.")
+
+	nsec := zoneSigner.DenialOfExistence("internal.", nil, 300)
+	assert.Equal(t, []uint16{dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}, nsec.TypeBitMap, "the apex has a SOA, even synthesized")
+
+	nsec = zoneSigner.DenialOfExistence("internal.", []uint16{dns.TypeSOA, TypeALIAS}, 300)
+	assert.Equal(t, []uint16{dns.TypeA, dns.TypeSOA, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}, nsec.TypeBitMap, "an ALIAS is answered with addresses")
+
+	nsec = zoneSigner.DenialOfExistence("foo.internal.", []uint16{dns.TypeDNSKEY, dns.TypeTXT}, 300)
+	assert.Equal(t, []uint16{dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}, nsec.TypeBitMap)
+}
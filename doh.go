@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultDohPath is the path of the DNS over HTTPS endpoint. c.f RFC 8484 section 4.1.1
+const DefaultDohPath = "/dns-query"
+
+// Media types of the DNS over HTTPS messages
+const (
+	DohMediaTypeMessage = "application/dns-message"
+	DohMediaTypeJSON    = "application/dns-json" // JSON API for debugging, the same as Google and Cloudflare
+)
+
+// Metrics of the DNS over HTTPS endpoint
+const (
+	DohQuery      = "doh-query"
+	DohBadRequest = "doh-bad-request"
+)
+
+// DohServer answers the DNS queries sent over HTTPS with the QuestionResolverHandler. c.f RFC 8484
+type DohServer struct {
+	handler        *QuestionResolverHandler
+	serve          dns.Handler // the handler of the admitted queries
+	trustedProxies []*net.IPNet
+	tsigSecrets    map[string]string
+	servermux      *http.ServeMux
+}
+
+// NewDohServer create the DNS over HTTPS endpoint of the handler
+func NewDohServer(handler *QuestionResolverHandler, config DohConfig) (*DohServer, error) {
+	trustedProxies, err := utils.ParseCIDRs(config.TrustedProxies)
+
+	if err != nil {
+		return nil, err
+	}
+
+	path := config.Path
+
+	if path == "" {
+		path = DefaultDohPath
+	}
+
+	s := &DohServer{
+		handler:        handler,
+		serve:          handler.ListenerHandler(ListenerHTTPS),
+		trustedProxies: trustedProxies,
+		tsigSecrets:    handler.TsigSecret(),
+		servermux:      http.NewServeMux(),
+	}
+
+	s.servermux.HandleFunc(path, s.serveHTTP)
+
+	return s, nil
+}
+
+// Start listen on the address of the configuration, over TLS when there is a certificate,
+// otherwise over plain HTTP for a TLS termination by a proxy
+func (s *DohServer) Start(config DohConfig, tlsConfig TlsConfig) error {
+	listener, err := net.Listen("tcp", config.Address)
+
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener, tlsConfig)
+}
+
+// Serve accept the connections of the listener until it's closed. The connections of a client are limited
+// like on the TCP listener, except over plain HTTP where all the connections come from the TLS proxy.
+func (s *DohServer) Serve(listener net.Listener, tlsConfig TlsConfig) error {
+	server := &http.Server{Handler: s.servermux}
+
+	if tlsConfig.CertFile == "" {
+		log.WithField("address", listener.Addr().String()).Warn("DNS over HTTPS listening without TLS, it must be behind a TLS proxy")
+		return server.Serve(listener)
+	}
+
+	loader, err := NewCertificateLoader(tlsConfig.CertFile, tlsConfig.KeyFile)
+
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	if err = loader.Watch(CertificateReloadInterval); err != nil {
+		listener.Close()
+		return err
+	}
+
+	defer loader.Stop()
+	server.TLSConfig = newServerTLSConfig(loader, "h2", "http/1.1")
+
+	return server.ServeTLS(s.handler.limitConnections(listener), "", "")
+}
+
+func (s *DohServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	jsonAPI := r.Method == http.MethodGet && r.URL.Query().Get("name") != ""
+	raw, m, err := s.readQuery(r, jsonAPI)
+
+	if err != nil {
+		log.WithField("ip", r.RemoteAddr).WithError(err).Warn("Rejected a DNS over HTTPS query")
+		s.handler.incMetric(DohBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.handler.incMetric(DohQuery)
+	rw := &dohResponseWriter{remoteAddr: s.clientAddr(r), tsigSecrets: s.tsigSecrets}
+
+	if tsig := m.IsTsig(); tsig != nil {
+		rw.requestMAC = tsig.MAC
+		rw.tsigStatus = dns.TsigVerify(raw, rw.tsigSecrets[strings.ToLower(tsig.Hdr.Name)], "", false)
+	}
+
+	// A zone transfer has many messages, it's only served over TCP
+	if len(m.Question) > 0 && (m.Question[0].Qtype == dns.TypeAXFR || m.Question[0].Qtype == dns.TypeIXFR) {
+		msg := new(dns.Msg)
+		msg.SetRcode(m, dns.RcodeRefused)
+		rw.WriteMsg(msg)
+	} else {
+		s.serve.ServeDNS(rw, m)
+	}
+
+	// The query is dropped by the admission control
+	if rw.raw == nil {
+		http.Error(w, "query rejected", http.StatusForbidden)
+		return
+	}
+
+	if jsonAPI {
+		s.writeJSON(w, rw.raw)
+	} else {
+		s.writeMessage(w, rw.raw)
+	}
+}
+
+// readQuery decode the DNS message of a GET with the parameter dns in base64url, of a POST with the message
+// in its body, or the question of the JSON API with the parameters name, type, cd and do
+func (s *DohServer) readQuery(r *http.Request, jsonAPI bool) (raw []byte, m *dns.Msg, err error) {
+	switch {
+	case jsonAPI:
+		return nil, newDohJSONQuery(r), nil
+	case r.Method == http.MethodGet:
+		// The padding is omitted in the base64url encoding of the messages. c.f RFC 8484 section 6
+		raw, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid base64url encoding of the parameter dns: %s", err)
+		}
+	case r.Method == http.MethodPost:
+		if contentType := r.Header.Get("Content-Type"); contentType != DohMediaTypeMessage {
+			return nil, nil, fmt.Errorf("unsupported content type %s, must be %s", contentType, DohMediaTypeMessage)
+		}
+
+		if raw, err = io.ReadAll(http.MaxBytesReader(nil, r.Body, dns.MaxMsgSize)); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported method %s", r.Method)
+	}
+
+	m = new(dns.Msg)
+
+	if err = m.Unpack(raw); err != nil {
+		return nil, nil, fmt.Errorf("invalid DNS message: %s", err)
+	}
+
+	return raw, m, nil
+}
+
+// newDohJSONQuery create the query of the JSON API, e.g: ?name=example.com&type=AAAA&do=1
+func newDohJSONQuery(r *http.Request) *dns.Msg {
+	params := r.URL.Query()
+	qtype := dns.TypeA
+
+	if t, found := dns.StringToType[strings.ToUpper(params.Get("type"))]; found {
+		qtype = t
+	} else if t, err := strconv.ParseUint(params.Get("type"), 10, 16); err == nil {
+		qtype = uint16(t)
+	}
+
+	m := new(dns.Msg).SetQuestion(dns.Fqdn(params.Get("name")), qtype)
+	m.CheckingDisabled = isTrue(params.Get("cd"))
+	m.SetEdns0(dns.MaxMsgSize, isTrue(params.Get("do")))
+
+	return m
+}
+
+func isTrue(param string) bool {
+	return param == "1" || strings.EqualFold(param, "true")
+}
+
+// clientAddr return the address of the client. Behind our trusted proxies, it's the last address of X-Forwarded-For
+// which isn't a trusted proxy, the previous ones are set by the client and can't be trusted.
+func (s *DohServer) clientAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+
+	if err != nil {
+		addr = &net.TCPAddr{}
+	}
+
+	if !utils.ContainsIP(s.trustedProxies, addr.IP) {
+		return addr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+
+		if ip == nil {
+			break
+		}
+
+		if addr = (&net.TCPAddr{IP: ip}); !utils.ContainsIP(s.trustedProxies, ip) {
+			break
+		}
+	}
+
+	return addr
+}
+
+// writeMessage write the response in the wire format, which can be cached until the smallest TTL expires.
+// c.f RFC 8484 section 5.1
+func (s *DohServer) writeMessage(w http.ResponseWriter, raw []byte) {
+	msg := new(dns.Msg)
+
+	if err := msg.Unpack(raw); err == nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(msg)))
+	}
+
+	w.Header().Set("Content-Type", DohMediaTypeMessage)
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.Write(raw)
+}
+
+// dohJSONResponse is the response of the JSON API
+type dohJSONResponse struct {
+	Status    int
+	TC        bool
+	RD        bool
+	RA        bool
+	AD        bool
+	CD        bool
+	Question  []dohJSONQuestion
+	Answer    []dohJSONRR `json:",omitempty"`
+	Authority []dohJSONRR `json:",omitempty"`
+}
+
+type dohJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type dohJSONRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+func (s *DohServer) writeJSON(w http.ResponseWriter, raw []byte) {
+	msg := new(dns.Msg)
+
+	if err := msg.Unpack(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := dohJSONResponse{
+		Status:    msg.Rcode,
+		TC:        msg.Truncated,
+		RD:        msg.RecursionDesired,
+		RA:        msg.RecursionAvailable,
+		AD:        msg.AuthenticatedData,
+		CD:        msg.CheckingDisabled,
+		Answer:    toDohJSONRRs(msg.Answer),
+		Authority: toDohJSONRRs(msg.Ns),
+	}
+
+	for _, question := range msg.Question {
+		response.Question = append(response.Question, dohJSONQuestion{Name: question.Name, Type: question.Qtype})
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", dohMaxAge(msg)))
+	w.Header().Set("Content-Type", DohMediaTypeJSON)
+	json.NewEncoder(w).Encode(response)
+}
+
+func toDohJSONRRs(rrs []dns.RR) (jsonRRs []dohJSONRR) {
+	for _, rr := range rrs {
+		jsonRRs = append(jsonRRs, dohJSONRR{
+			Name: rr.Header().Name,
+			Type: rr.Header().Rrtype,
+			TTL:  rr.Header().Ttl,
+			Data: strings.TrimPrefix(rr.String(), rr.Header().String()),
+		})
+	}
+
+	return
+}
+
+// dohMaxAge return the freshness lifetime of a response: the smallest TTL of its RRs,
+// or the negative TTL of the SOA of a negative answer. c.f RFC 8484 section 5.1
+func dohMaxAge(msg *dns.Msg) uint32 {
+	ttl := minTTL(append(append([]dns.RR{}, msg.Answer...), msg.Ns...))
+
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && len(msg.Answer) == 0 && soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+
+	return ttl
+}
+
+// dohResponseWriter is the dns.ResponseWriter of a DNS over HTTPS query, it keeps the response in the wire format
+type dohResponseWriter struct {
+	remoteAddr  net.Addr
+	raw         []byte
+	tsigSecrets map[string]string
+	tsigStatus  error
+	requestMAC  string
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+
+// WriteMsg pack the response, signed when the query is signed
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) (err error) {
+	if tsig := m.IsTsig(); tsig != nil {
+		w.raw, _, err = dns.TsigGenerate(m, w.tsigSecrets[strings.ToLower(tsig.Hdr.Name)], w.requestMAC, false)
+	} else {
+		w.raw, err = m.Pack()
+	}
+
+	return err
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.raw = append([]byte{}, b...)
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type DohTestSuite struct {
+	suite.Suite
+	handler QuestionResolverHandler
+	server  *DohServer
+}
+
+func (suite *DohTestSuite) SetupTest() {
+	config := DnsConfig{Zones: []string{"internal."}, Recursion: RecursionConfig{AllowedIPs: []string{"198.51.100.0/24"}}}
+	suite.handler = newTestHandler(config, []dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")})
+	suite.handler.resolver = &testResolver{}
+
+	var err error
+	suite.server, err = NewDohServer(&suite.handler, DohConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	suite.Nil(err)
+}
+
+func (suite *DohTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *DohTestSuite) serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	suite.server.servermux.ServeHTTP(w, r)
+
+	return w
+}
+
+func (suite *DohTestSuite) unpack(w *httptest.ResponseRecorder) *dns.Msg {
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(DohMediaTypeMessage, w.Header().Get("Content-Type"))
+
+	msg := new(dns.Msg)
+	suite.Nil(msg.Unpack(w.Body.Bytes()))
+
+	return msg
+}
+
+func (suite *DohTestSuite) TestShouldAnswerAGetQuery() {
+	m := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+	m.Id = 0
+	raw, _ := m.Pack()
+
+	w := suite.serve(httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(raw), nil))
+	msg := suite.unpack(w)
+
+	suite.Len(msg.Answer, 1)
+	suite.True(msg.Authoritative)
+	suite.Equal("max-age=2700", w.Header().Get("Cache-Control"))
+}
+
+func (suite *DohTestSuite) TestShouldAnswerAPostQuery() {
+	raw, _ := new(dns.Msg).SetQuestion("bar.internal.", dns.TypeA).Pack()
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(raw))
+	r.Header.Set("Content-Type", DohMediaTypeMessage)
+
+	msg := suite.unpack(suite.serve(r))
+	suite.Equal(dns.RcodeNameError, msg.Rcode)
+}
+
+func (suite *DohTestSuite) TestShouldAnswerTheJSONAPI() {
+	w := suite.serve(httptest.NewRequest(http.MethodGet, "/dns-query?name=foo.internal&type=a", nil))
+
+	suite.Equal(http.StatusOK, w.Code)
+	suite.Equal(DohMediaTypeJSON, w.Header().Get("Content-Type"))
+
+	var response dohJSONResponse
+	suite.Nil(json.NewDecoder(w.Body).Decode(&response))
+	suite.Equal(dns.RcodeSuccess, response.Status)
+	suite.Equal([]dohJSONQuestion{{Name: "foo.internal.", Type: dns.TypeA}}, response.Question)
+	suite.Equal([]dohJSONRR{{Name: "foo.internal.", Type: dns.TypeA, TTL: 2700, Data: "127.0.0.1"}}, response.Answer)
+}
+
+func (suite *DohTestSuite) TestShouldRejectTheInvalidRequests() {
+	suite.Equal(http.StatusBadRequest, suite.serve(httptest.NewRequest(http.MethodGet, "/dns-query?dns=!!!", nil)).Code)
+	suite.Equal(http.StatusBadRequest, suite.serve(httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil)).Code)
+	suite.Equal(http.StatusBadRequest, suite.serve(httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader([]byte("{}")))).Code)
+	suite.Equal(http.StatusBadRequest, suite.serve(httptest.NewRequest(http.MethodPut, "/dns-query", nil)).Code)
+}
+
+func (suite *DohTestSuite) TestShouldTrustTheForwardedForOfTheTrustedProxies() {
+	query := func(remoteAddr string, forwardedFor string) (response dohJSONResponse) {
+		r := httptest.NewRequest(http.MethodGet, "/dns-query?name=www.example.com", nil)
+		r.RemoteAddr = remoteAddr
+
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+
+		suite.Nil(json.NewDecoder(suite.serve(r).Body).Decode(&response))
+		return
+	}
+
+	suite.True(query("198.51.100.1:4242", "").RA)
+	suite.True(query("10.0.0.1:4242", "198.51.100.1").RA)
+	suite.True(query("10.0.0.1:4242", "192.0.2.1, 198.51.100.1, 10.0.0.2").RA)
+	suite.Equal(dns.RcodeRefused, query("10.0.0.1:4242", "198.51.100.1, 192.0.2.1").Status, "the last untrusted address is the client")
+	suite.Equal(dns.RcodeRefused, query("192.0.2.1:4242", "198.51.100.1").Status, "an untrusted client can't forge its address")
+}
+
+func TestDohTestSuite(t *testing.T) {
+	suite.Run(t, new(DohTestSuite))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Error codes of the DNS over QUIC connections and streams. c.f RFC 9250 section 4.3
+const (
+	DoqNoError          quic.ApplicationErrorCode = 0x0
+	DoqInternalError    quic.ApplicationErrorCode = 0x1
+	DoqProtocolError    quic.ApplicationErrorCode = 0x2
+	DoqRequestCancelled quic.ApplicationErrorCode = 0x3
+)
+
+// DNS over QUIC configuration.
+const (
+	DefaultDoqIdleTimeout = 30000 * time.Millisecond
+	DefaultDoqMaxStreams  = 100
+	// Maximum duration to receive the query of a stream, so the streams left open by the clients don't pile up
+	DoqReadTimeout = 5000 * time.Millisecond
+)
+
+// Metrics of the DNS over QUIC listener
+const (
+	DoqConnection     = "doq-connection"
+	DoqConnection0RTT = "doq-connection-0rtt"
+	DoqStreamError    = "doq-stream-error"
+)
+
+// DoqServer answers the DNS queries sent over QUIC with the QuestionResolverHandler, one query by stream. c.f RFC 9250
+type DoqServer struct {
+	handler  *QuestionResolverHandler
+	serve    dns.Handler // the handler of the admitted queries
+	listener *quic.EarlyListener
+	loader   *CertificateLoader
+}
+
+// NewDoqServer create the DNS over QUIC server of the handler, listening on the address of the configuration
+// with the certificate of the DNS over TLS listener
+func NewDoqServer(handler *QuestionResolverHandler, config DoqConfig, tlsConfig TlsConfig) (*DoqServer, error) {
+	if tlsConfig.CertFile == "" {
+		return nil, errors.New("DNS over QUIC requires a certificate, set DNS_TLS_CERT_FILE and DNS_TLS_KEY_FILE")
+	}
+
+	loader, err := NewCertificateLoader(tlsConfig.CertFile, tlsConfig.KeyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	quicConfig := &quic.Config{
+		MaxIdleTimeout:     config.IdleTimeout,
+		MaxIncomingStreams: int64(config.MaxStreams),
+		Allow0RTT:          config.Allow0RTT,
+	}
+
+	if quicConfig.MaxIdleTimeout <= 0 {
+		quicConfig.MaxIdleTimeout = DefaultDoqIdleTimeout
+	}
+
+	if quicConfig.MaxIncomingStreams <= 0 {
+		quicConfig.MaxIncomingStreams = DefaultDoqMaxStreams
+	}
+
+	listener, err := quic.ListenAddrEarly(config.Address, newServerTLSConfig(loader, "doq"), quicConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = loader.Watch(CertificateReloadInterval); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &DoqServer{handler: handler, serve: handler.ListenerHandler(ListenerQUIC), listener: listener, loader: loader}, nil
+}
+
+// Addr return the address of the listener
+func (s *DoqServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accept the connections until the listener is closed
+func (s *DoqServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept(context.Background())
+
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stop the listener and close its connections
+func (s *DoqServer) Close() error {
+	s.loader.Stop()
+	return s.listener.Close()
+}
+
+func (s *DoqServer) serveConn(conn quic.EarlyConnection) {
+	s.handler.incMetric(DoqConnection)
+
+	if conn.ConnectionState().Used0RTT {
+		s.handler.incMetric(DoqConnection0RTT)
+	}
+
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+
+		if err != nil {
+			// The connection is closed by the client or after its idle timeout
+			return
+		}
+
+		go s.serveStream(conn, stream)
+	}
+}
+
+// serveStream answer the query of the stream. The stream is closed after the response,
+// or after all the responses of a zone transfer.
+func (s *DoqServer) serveStream(conn quic.EarlyConnection, stream quic.Stream) {
+	stream.SetReadDeadline(time.Now().Add(DoqReadTimeout))
+	raw, err := readDoqMessage(stream)
+
+	if err != nil {
+		log.WithField("ip", conn.RemoteAddr().String()).WithError(err).Debug("Can't read the DNS over QUIC query")
+		s.handler.incMetric(DoqStreamError)
+		stream.CancelRead(quic.StreamErrorCode(DoqRequestCancelled))
+		stream.CancelWrite(quic.StreamErrorCode(DoqRequestCancelled))
+		return
+	}
+
+	m := new(dns.Msg)
+
+	if err = m.Unpack(raw); err != nil || !isValidDoqQuery(m) {
+		// An invalid message is a protocol error, which closes the connection. c.f RFC 9250 section 4.3.3
+		s.handler.incMetric(DoqStreamError)
+		conn.CloseWithError(DoqProtocolError, "invalid DNS over QUIC query")
+		return
+	}
+
+	// The 0-RTT data can be replayed: the queries which aren't replayable, the zone transfers and
+	// the signed queries, wait for the end of the handshake. c.f RFC 9250 section 4.5
+	if qtype := m.Question[0].Qtype; m.IsTsig() != nil || qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			return
+		}
+	}
+
+	rw := &doqResponseWriter{conn: conn, stream: stream, tsigSecrets: s.handler.TsigSecret()}
+
+	if tsig := m.IsTsig(); tsig != nil {
+		rw.requestMAC = tsig.MAC
+		rw.tsigStatus = dns.TsigVerify(raw, rw.tsigSecrets[strings.ToLower(tsig.Hdr.Name)], "", false)
+	}
+
+	s.serve.ServeDNS(rw, m)
+	stream.Close()
+}
+
+// readDoqMessage read a message prefixed with its length, like over TCP. c.f RFC 9250 section 4.2
+func readDoqMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, length)
+
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+// isValidDoqQuery check the rules of DNS over QUIC: the ID is 0, as the stream identifies the query,
+// and the keepalive option is forbidden as QUIC has its own idle timeout. c.f RFC 9250 section 4.2.1 and 5.5.2
+func isValidDoqQuery(m *dns.Msg) bool {
+	if m.Id != 0 || len(m.Question) == 0 {
+		return false
+	}
+
+	if opt := m.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if option.Option() == dns.EDNS0TCPKEEPALIVE {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// doqResponseWriter is the dns.ResponseWriter of a DNS over QUIC stream
+type doqResponseWriter struct {
+	conn           quic.Connection
+	stream         quic.Stream
+	tsigSecrets    map[string]string
+	tsigStatus     error
+	tsigTimersOnly bool
+	requestMAC     string // MAC of the query, then of the previous response of a zone transfer
+}
+
+func (w *doqResponseWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *doqResponseWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+// WriteMsg pack the response, signed when the query is signed
+func (w *doqResponseWriter) WriteMsg(m *dns.Msg) (err error) {
+	var raw []byte
+
+	if tsig := m.IsTsig(); tsig != nil {
+		raw, w.requestMAC, err = dns.TsigGenerate(m, w.tsigSecrets[strings.ToLower(tsig.Hdr.Name)], w.requestMAC, w.tsigTimersOnly)
+	} else {
+		raw, err = m.Pack()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(raw)
+	return err
+}
+
+// Write send the response prefixed with its length
+func (w *doqResponseWriter) Write(b []byte) (int, error) {
+	raw := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(raw, uint16(len(b)))
+
+	if _, err := w.stream.Write(append(raw, b...)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (w *doqResponseWriter) Close() error                   { return w.stream.Close() }
+func (w *doqResponseWriter) TsigStatus() error              { return w.tsigStatus }
+func (w *doqResponseWriter) TsigTimersOnly(timersOnly bool) { w.tsigTimersOnly = timersOnly }
+func (w *doqResponseWriter) Hijack()                        {}
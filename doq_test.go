@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type DoqTestSuite struct {
+	suite.Suite
+	handler  QuestionResolverHandler
+	server   *DoqServer
+	certFile string
+	keyFile  string
+}
+
+func (suite *DoqTestSuite) SetupTest() {
+	id := uuid.New().String()
+	suite.handler = newTestHandler(DnsConfig{Zones: []string{"internal."}}, []dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")})
+	suite.certFile = fmt.Sprintf("/tmp/%s.crt", id)
+	suite.keyFile = fmt.Sprintf("/tmp/%s.key", id)
+	suite.Nil(writeTestCertificate(suite.certFile, suite.keyFile, "dns.internal"))
+
+	var err error
+	suite.server, err = NewDoqServer(&suite.handler, DoqConfig{Address: "127.0.0.1:0"}, TlsConfig{CertFile: suite.certFile, KeyFile: suite.keyFile})
+	suite.Nil(err)
+
+	go suite.server.Serve()
+}
+
+func (suite *DoqTestSuite) TearDownTest() {
+	suite.server.Close()
+	closeTestDB(suite.handler.db)
+	os.Remove(suite.certFile)
+	os.Remove(suite.keyFile)
+}
+
+func (suite *DoqTestSuite) dial() (quic.Connection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return quic.DialAddr(ctx, suite.server.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}, nil)
+}
+
+// exchange send the query on a new stream of the connection and read the response
+func (suite *DoqTestSuite) exchange(conn quic.Connection, m *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(context.Background())
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := m.Pack()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The client closes its side of the stream after the query. c.f RFC 9250 section 4.2
+	query := make([]byte, 2, 2+len(raw))
+	binary.BigEndian.PutUint16(query, uint16(len(raw)))
+	stream.Write(append(query, raw...))
+	stream.Close()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	raw, err = readDoqMessage(stream)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	return r, r.Unpack(raw)
+}
+
+func (suite *DoqTestSuite) TestShouldAnswerEachStreamOfAConnection() {
+	conn, err := suite.dial()
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	defer conn.CloseWithError(DoqNoError, "")
+
+	for _, qname := range []string{"foo.internal.", "bar.internal."} {
+		m := new(dns.Msg).SetQuestion(qname, dns.TypeA)
+		m.Id = 0
+
+		r, err := suite.exchange(conn, m)
+
+		if suite.Nil(err, qname) {
+			suite.Equal(uint16(0), r.Id)
+			suite.True(r.Authoritative)
+		}
+	}
+}
+
+func (suite *DoqTestSuite) TestShouldNeverTruncateTheResponses() {
+	rrs := []dns.RR{}
+
+	for i := 0; i < 40; i++ {
+		rrs = append(rrs, testRR(fmt.Sprintf("large.internal. 2700 IN A 10.0.0.%d", i)))
+	}
+
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		return putRRset(tx, []byte("large.internal.|A"), testMarshalRR(rrs))
+	})
+
+	conn, err := suite.dial()
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	defer conn.CloseWithError(DoqNoError, "")
+
+	m := new(dns.Msg).SetQuestion("large.internal.", dns.TypeA)
+	m.Id = 0
+	r, err := suite.exchange(conn, m)
+
+	if suite.Nil(err) {
+		suite.False(r.Truncated)
+		suite.Len(r.Answer, 40)
+	}
+}
+
+func (suite *DoqTestSuite) TestShouldCloseTheConnectionOnAQueryWithAnID() {
+	conn, err := suite.dial()
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	_, err = suite.exchange(conn, new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+	suite.NotNil(err)
+
+	select {
+	case <-conn.Context().Done():
+		var appErr *quic.ApplicationError
+
+		if suite.ErrorAs(context.Cause(conn.Context()), &appErr) {
+			suite.Equal(DoqProtocolError, appErr.ErrorCode)
+		}
+	case <-time.After(5 * time.Second):
+		suite.Fail("the connection isn't closed")
+	}
+}
+
+func (suite *DoqTestSuite) TestShouldRequireACertificate() {
+	_, err := NewDoqServer(&suite.handler, DoqConfig{Address: "127.0.0.1:0"}, TlsConfig{})
+	suite.NotNil(err)
+}
+
+func TestDoqTestSuite(t *testing.T) {
+	suite.Run(t, new(DoqTestSuite))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// CertificateReloadInterval is the interval between two checks of the certificate files
+const CertificateReloadInterval = 10 * time.Second
+
+// Metrics of the TLS sessions of the DNS over TLS listener
+const (
+	DotConnection     = "dot-connection"
+	DotHandshakeError = "dot-handshake-error"
+	DotSessionNew     = "dot-session-new"
+	DotSessionResumed = "dot-session-resumed"
+)
+
+// CertificateLoader serves the certificate of the TLS listeners, it's reloaded when its files change
+// so a renewed certificate is used without a restart.
+type CertificateLoader struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time     // most recent modification of the certificate or the key
+	stop        chan struct{} // closed by Stop to end the watch of the files
+	stopOnce    sync.Once
+}
+
+// NewCertificateLoader load the certificate and its key in the PEM format
+func NewCertificateLoader(certFile string, keyFile string) (*CertificateLoader, error) {
+	loader := &CertificateLoader{certFile: certFile, keyFile: keyFile, stop: make(chan struct{})}
+
+	if _, err := loader.Reload(); err != nil {
+		return nil, err
+	}
+
+	return loader, nil
+}
+
+// Reload load the certificate again when one of its files changed since the last load.
+// On error, the previous certificate is kept.
+func (l *CertificateLoader) Reload() (reloaded bool, err error) {
+	modTime, err := l.lastModification()
+
+	if err != nil {
+		return false, err
+	}
+
+	l.mutex.RLock()
+	unchanged := l.certificate != nil && modTime.Equal(l.modTime)
+	l.mutex.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+
+	if err != nil {
+		return false, err
+	}
+
+	l.mutex.Lock()
+	l.certificate = &certificate
+	l.modTime = modTime
+	l.mutex.Unlock()
+
+	return true, nil
+}
+
+func (l *CertificateLoader) lastModification() (modTime time.Time, err error) {
+	for _, file := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return modTime, err
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+// Watch check the certificate files periodically in background until Stop
+func (l *CertificateLoader) Watch(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid certificate reload interval %s, must be positive", interval)
+	}
+
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				reloaded, err := l.Reload()
+
+				if err != nil {
+					log.WithField("certificate", l.certFile).WithError(err).Error("Can't reload the certificate, the previous one is kept")
+				} else if reloaded {
+					log.WithField("certificate", l.certFile).Info("Reloaded the certificate")
+				}
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop end the watch of the certificate files
+func (l *CertificateLoader) Stop() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// GetCertificate return the current certificate, it's the tls.Config.GetCertificate of the TLS listeners
+func (l *CertificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.certificate, nil
+}
+
+// newServerTLSConfig return the TLS configuration of a listener, which negotiates the application protocols
+func newServerTLSConfig(loader *CertificateLoader, protocols ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: loader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     protocols,
+	}
+}
+
+// dotListener accepts the DNS over TLS connections and counts their TLS sessions. c.f RFC 7858
+type dotListener struct {
+	net.Listener
+	config    *tls.Config
+	loader    *CertificateLoader
+	incMetric func(metricName string)
+}
+
+func (l *dotListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.incMetric(DotConnection)
+
+	return &dotConn{Conn: tls.Server(conn, l.config), incMetric: l.incMetric}, nil
+}
+
+// Close stop the watch of the certificate with the listener
+func (l *dotListener) Close() error {
+	l.loader.Stop()
+	return l.Listener.Close()
+}
+
+// dotConn does the TLS handshake on the first read, in the goroutine of the connection,
+// so a slow client doesn't block the other connections.
+type dotConn struct {
+	*tls.Conn
+	handshake sync.Once
+	incMetric func(metricName string)
+}
+
+func (c *dotConn) Read(b []byte) (int, error) {
+	var err error
+
+	c.handshake.Do(func() {
+		if err = c.Conn.Handshake(); err != nil {
+			log.WithField("ip", c.RemoteAddr().String()).WithError(err).Debug("The TLS handshake failed")
+			c.incMetric(DotHandshakeError)
+		} else if c.ConnectionState().DidResume {
+			c.incMetric(DotSessionResumed)
+		} else {
+			c.incMetric(DotSessionNew)
+		}
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+// newDotServer create the DNS over TLS server of the handler, listening on the address of the configuration
+func newDotServer(handler *QuestionResolverHandler, config TlsConfig) (*dns.Server, error) {
+	loader, err := NewCertificateLoader(config.CertFile, config.KeyFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", config.Address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = loader.Watch(CertificateReloadInterval); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &dns.Server{
+		Listener:      &dotListener{Listener: handler.limitConnections(listener), config: newServerTLSConfig(loader, "dot"), loader: loader, incMetric: handler.incMetric},
+		Net:           "tcp-tls",
+		Handler:       handler.ListenerHandler(ListenerTLS),
+		TsigSecret:    handler.TsigSecret(),
+		MsgAcceptFunc: acceptQueryFunc,
+	}, nil
+}
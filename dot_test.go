@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+// writeTestCertificate write a self-signed certificate for the name and its key in the PEM format
+func writeTestCertificate(certFile string, keyFile string, name string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return err
+	}
+
+	rawKey, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600)
+}
+
+type DotTestSuite struct {
+	suite.Suite
+	handler  QuestionResolverHandler
+	certFile string
+	keyFile  string
+}
+
+func (suite *DotTestSuite) SetupTest() {
+	id := uuid.New().String()
+	suite.handler = newTestHandler(DnsConfig{Zones: []string{"internal."}}, []dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")})
+	suite.certFile = fmt.Sprintf("/tmp/%s.crt", id)
+	suite.keyFile = fmt.Sprintf("/tmp/%s.key", id)
+	suite.Nil(writeTestCertificate(suite.certFile, suite.keyFile, "dns.internal"))
+}
+
+func (suite *DotTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+	os.Remove(suite.certFile)
+	os.Remove(suite.keyFile)
+}
+
+func (suite *DotTestSuite) TestShouldAnswerOverTLS() {
+	server, err := newDotServer(&suite.handler, TlsConfig{Address: "127.0.0.1:0", CertFile: suite.certFile, KeyFile: suite.keyFile})
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	metrics := map[string]int{}
+	var mutex sync.Mutex
+	server.Listener.(*dotListener).incMetric = func(metricName string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		metrics[metricName]++
+	}
+
+	go server.ActivateAndServe()
+	defer func() {
+		server.Shutdown()
+		_, open := <-server.Listener.(*dotListener).loader.stop
+		suite.False(open, "the watch of the certificate stops with the listener")
+	}()
+
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "dns.internal"}}
+	r, _, err := client.Exchange(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA), server.Listener.Addr().String())
+
+	if suite.Nil(err) {
+		suite.Len(r.Answer, 1)
+		suite.True(r.Authoritative)
+	}
+
+	// The client doesn't trust our self-signed certificate
+	client.TLSConfig = &tls.Config{ServerName: "dns.internal"}
+	_, _, err = client.Exchange(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA), server.Listener.Addr().String())
+	suite.NotNil(err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	suite.Equal(2, metrics[DotConnection])
+	suite.Equal(1, metrics[DotSessionNew])
+}
+
+func (suite *DotTestSuite) TestShouldReloadTheCertificateWhenItChanges() {
+	loader, err := NewCertificateLoader(suite.certFile, suite.keyFile)
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	reloaded, err := loader.Reload()
+	suite.Nil(err)
+	suite.False(reloaded, "the files didn't change")
+
+	previous, _ := loader.GetCertificate(nil)
+	suite.Nil(writeTestCertificate(suite.certFile, suite.keyFile, "dns2.internal"))
+	// The modification time may have a coarse resolution
+	later := time.Now().Add(time.Second)
+	os.Chtimes(suite.certFile, later, later)
+
+	reloaded, err = loader.Reload()
+	suite.Nil(err)
+	suite.True(reloaded)
+
+	current, _ := loader.GetCertificate(nil)
+	suite.NotEqual(previous.Certificate[0], current.Certificate[0])
+
+	// A broken certificate is ignored
+	os.WriteFile(suite.certFile, []byte("not a certificate"), 0600)
+	later = later.Add(time.Second)
+	os.Chtimes(suite.certFile, later, later)
+
+	_, err = loader.Reload()
+	suite.NotNil(err)
+
+	kept, _ := loader.GetCertificate(nil)
+	suite.Equal(current, kept)
+}
+
+func (suite *DotTestSuite) TestShouldWatchTheCertificateUntilStop() {
+	loader, err := NewCertificateLoader(suite.certFile, suite.keyFile)
+
+	if !suite.Nil(err) {
+		return
+	}
+
+	suite.NotNil(loader.Watch(0))
+	suite.NotNil(loader.Watch(-time.Second))
+
+	if !suite.Nil(loader.Watch(time.Millisecond)) {
+		return
+	}
+
+	previous, _ := loader.GetCertificate(nil)
+	suite.Nil(writeTestCertificate(suite.certFile, suite.keyFile, "dns2.internal"))
+	later := time.Now().Add(time.Second)
+	os.Chtimes(suite.certFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+
+	current, _ := loader.GetCertificate(nil)
+	suite.NotEqual(previous.Certificate[0], current.Certificate[0])
+
+	loader.Stop()
+	loader.Stop()
+	time.Sleep(5 * time.Millisecond)
+
+	suite.Nil(writeTestCertificate(suite.certFile, suite.keyFile, "dns3.internal"))
+	later = later.Add(time.Second)
+	os.Chtimes(suite.certFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+
+	kept, _ := loader.GetCertificate(nil)
+	suite.Equal(current, kept, "the certificate isn't reloaded after Stop")
+}
+
+func TestDotTestSuite(t *testing.T) {
+	suite.Run(t, new(DotTestSuite))
+}
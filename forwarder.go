@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	a "stream-dns/agent"
+	ms "stream-dns/metrics"
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policies to choose the upstream of a forwarded query
+const (
+	ForwardPolicyRoundRobin = "round-robin" // each query starts with the next upstream
+	ForwardPolicySequential = "sequential"  // the upstreams are always tried in the order of the configuration
+	ForwardPolicyFastest    = "fastest"     // the upstream with the smallest round trip time first
+)
+
+// Transports to the upstreams
+const (
+	ForwardTransportUDP = "udp"
+	ForwardTransportTCP = "tcp"
+	ForwardTransportTLS = "tls" // DNS over TLS. c.f RFC 7858
+)
+
+// Forwarding configuration.
+const (
+	DefaultForwardTimeout             = 2000 * time.Millisecond
+	DefaultForwardHealthCheckInterval = 10000 * time.Millisecond
+	// Consecutive failures after which an upstream is unhealthy, it's only tried when all the upstreams are
+	UpstreamMaxFails = 3
+)
+
+// Upstream is a recursive name server the queries are forwarded to
+type Upstream struct {
+	Address    string // host:port
+	Transport  string
+	Timeout    time.Duration
+	ServerName string // name checked in the certificate of a DoT upstream
+	client     *dns.Client
+	mutex      sync.RWMutex
+	fails      int           // consecutive failures
+	rtt        time.Duration // smoothed round trip time
+}
+
+// Forwarder resolves the queries out of our zones with upstream recursive name servers, instead of iterating from the root.
+type Forwarder struct {
+	upstreams           []*Upstream
+	policy              string
+	healthCheckInterval time.Duration
+	next                uint32 // index of the first upstream of the next query with the round-robin policy
+	ms                  *a.MetricsService
+	exchange            func(u *Upstream, m *dns.Msg) (*dns.Msg, time.Duration, error)
+	stop                chan struct{} // closed by Stop to end the health checks
+	stopOnce            sync.Once
+}
+
+// NewForwarder create a Forwarder for the upstreams of the configuration
+func NewForwarder(config ForwardConfig, metricsService *a.MetricsService) (*Forwarder, error) {
+	policy, err := ParseForwardPolicy(config.Policy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	forwarder := &Forwarder{
+		policy:              policy,
+		healthCheckInterval: config.HealthCheckInterval,
+		ms:                  metricsService,
+		exchange:            exchangeWithUpstream,
+		stop:                make(chan struct{}),
+	}
+
+	if forwarder.healthCheckInterval == 0 {
+		forwarder.healthCheckInterval = DefaultForwardHealthCheckInterval
+	}
+
+	if forwarder.healthCheckInterval < 0 {
+		return nil, fmt.Errorf("invalid health check interval %s, must be positive", forwarder.healthCheckInterval)
+	}
+
+	for _, raw := range config.Upstreams {
+		upstream, err := ParseUpstream(raw, config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		forwarder.upstreams = append(forwarder.upstreams, upstream)
+	}
+
+	if len(forwarder.upstreams) == 0 {
+		return nil, fmt.Errorf("the forwarder has no upstream")
+	}
+
+	return forwarder, nil
+}
+
+// ParseForwardPolicy check the policy of the configuration, the upstreams are used in round-robin by default
+func ParseForwardPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return ForwardPolicyRoundRobin, nil
+	case ForwardPolicyRoundRobin, ForwardPolicySequential, ForwardPolicyFastest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown forward policy %s, must be one of %s, %s or %s", policy, ForwardPolicyRoundRobin, ForwardPolicySequential, ForwardPolicyFastest)
+	}
+}
+
+// ParseUpstream read an upstream with the format [<transport>://]<address>[:<port>][?timeout=<duration>&servername=<name>],
+// e.g: "9.9.9.9", "tcp://10.0.0.53:5353" or "tls://9.9.9.9?servername=dns.quad9.net&timeout=500ms".
+// The transport and the timeout default to the ones of the configuration, the port to 53, or 853 for DNS over TLS.
+func ParseUpstream(raw string, config ForwardConfig) (*Upstream, error) {
+	transport := config.Transport
+
+	if transport == "" {
+		transport = ForwardTransportUDP
+	}
+
+	if parts := strings.SplitN(raw, "://", 2); len(parts) == 2 {
+		transport, raw = parts[0], parts[1]
+	}
+
+	// A bare IPv6 address must be enclosed in brackets to be read as the host of an URL
+	if host := strings.SplitN(raw, "?", 2)[0]; strings.Count(host, ":") > 1 && !strings.HasPrefix(host, "[") {
+		raw = "[" + host + "]" + strings.TrimPrefix(raw, host)
+	}
+
+	u, err := url.Parse(transport + "://" + raw)
+
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid upstream %s", raw)
+	}
+
+	upstream := &Upstream{Transport: transport, Timeout: config.Timeout, ServerName: u.Query().Get("servername")}
+	port := u.Port()
+
+	switch transport {
+	case ForwardTransportUDP, ForwardTransportTCP:
+		upstream.client = &dns.Client{Net: transport}
+
+		if port == "" {
+			port = "53"
+		}
+	case ForwardTransportTLS:
+		upstream.client = &dns.Client{Net: "tcp-tls"}
+
+		if port == "" {
+			port = "853"
+		}
+
+		if upstream.ServerName == "" {
+			upstream.ServerName = u.Hostname()
+		}
+
+		upstream.client.TLSConfig = newUpstreamTLSConfig(upstream.ServerName)
+	default:
+		return nil, fmt.Errorf("unknown transport %s of the upstream %s, must be one of %s, %s or %s", transport, raw, ForwardTransportUDP, ForwardTransportTCP, ForwardTransportTLS)
+	}
+
+	upstream.Address = net.JoinHostPort(u.Hostname(), port)
+
+	if timeout := u.Query().Get("timeout"); timeout != "" {
+		if upstream.Timeout, err = time.ParseDuration(timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout of the upstream %s: %s", raw, err)
+		}
+	}
+
+	if upstream.Timeout <= 0 {
+		upstream.Timeout = DefaultForwardTimeout
+	}
+
+	upstream.client.Timeout = upstream.Timeout
+
+	return upstream, nil
+}
+
+func newUpstreamTLSConfig(serverName string) *tls.Config {
+	return &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+}
+
+// exchangeWithUpstream send the query to the upstream. A response truncated over UDP is asked again over TCP.
+func exchangeWithUpstream(u *Upstream, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := u.client.Exchange(m, u.Address)
+
+	if err == nil && r.Truncated && u.Transport == ForwardTransportUDP {
+		client := &dns.Client{Net: "tcp", Timeout: u.Timeout}
+		r, rtt, err = client.Exchange(m, u.Address)
+	}
+
+	return r, rtt, err
+}
+
+// Resolve forward the query to the upstreams, in the order of the policy, until one of them answers.
+// It returns an error when none of the upstreams answered, so the client gets a SERVFAIL.
+func (f *Forwarder) Resolve(qname string, qtype uint16) ([]dns.RR, error) {
+	r, err := f.Exchange(qname, qtype)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.Answer, nil
+}
+
+// Exchange forward the query like Resolve, it returns the whole response of the upstream: a NXDOMAIN or a NODATA
+// can only be told apart with its rcode, and the authority section has the SOA for the negative caching. c.f RFC 2308
+func (f *Forwarder) Exchange(qname string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg).SetQuestion(dns.Fqdn(qname), qtype)
+	m.SetEdns0(DefaultMaxUdpSize, false)
+
+	for _, upstream := range f.upstreamsInOrder() {
+		r, rtt, err := f.exchange(upstream, m)
+
+		if err == nil && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("the upstream answered %s", dns.RcodeToString[r.Rcode])
+		}
+
+		upstream.report(rtt, err)
+
+		if err != nil {
+			log.WithFields(log.Fields{"upstream": upstream.Address, "qname": qname}).WithError(err).Warn("The upstream failed to resolve the query")
+			f.incMetric("forward-upstream-error")
+			continue
+		}
+
+		f.incMetric("forward-query")
+		return r, nil
+	}
+
+	f.incMetric("forward-failed")
+	return nil, fmt.Errorf("no upstream resolved %s %s", qname, dns.TypeToString[qtype])
+}
+
+// upstreamsInOrder return the upstreams in the order of the policy, the unhealthy ones at the end
+func (f *Forwarder) upstreamsInOrder() []*Upstream {
+	ordered := make([]*Upstream, 0, len(f.upstreams))
+
+	switch f.policy {
+	case ForwardPolicyRoundRobin:
+		start := int(atomic.AddUint32(&f.next, 1)-1) % len(f.upstreams)
+		ordered = append(ordered, f.upstreams[start:]...)
+		ordered = append(ordered, f.upstreams[:start]...)
+	case ForwardPolicyFastest:
+		ordered = append(ordered, f.upstreams...)
+		sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].RTT() < ordered[j].RTT() })
+	default:
+		ordered = append(ordered, f.upstreams...)
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Healthy() && !ordered[j].Healthy() })
+
+	return ordered
+}
+
+// StartHealthChecks check the upstreams periodically in background until Stop,
+// so an unhealthy upstream comes back when it answers again
+func (f *Forwarder) StartHealthChecks() {
+	ticker := time.NewTicker(f.healthCheckInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				f.checkHealth()
+			case <-f.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop end the health checks of the upstreams
+func (f *Forwarder) Stop() {
+	f.stopOnce.Do(func() { close(f.stop) })
+}
+
+// checkHealth ask the NS of the root to all the upstreams
+func (f *Forwarder) checkHealth() {
+	var wg sync.WaitGroup
+
+	for _, upstream := range f.upstreams {
+		wg.Add(1)
+
+		go func(upstream *Upstream) {
+			defer wg.Done()
+
+			m := new(dns.Msg).SetQuestion(".", dns.TypeNS)
+			r, rtt, err := f.exchange(upstream, m)
+
+			if err == nil && r.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("the upstream answered %s", dns.RcodeToString[r.Rcode])
+			}
+
+			if err != nil && upstream.Healthy() {
+				log.WithField("upstream", upstream.Address).WithError(err).Warn("The health check of the upstream failed")
+			}
+
+			upstream.report(rtt, err)
+		}(upstream)
+	}
+
+	wg.Wait()
+}
+
+// report keep the result of an exchange with the upstream
+func (u *Upstream) report(rtt time.Duration, err error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if err != nil {
+		u.fails++
+		return
+	}
+
+	u.fails = 0
+
+	// Exponentially weighted moving average, like the SRTT of TCP. c.f RFC 6298
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = (7*u.rtt + rtt) / 8
+	}
+}
+
+// Healthy look if the upstream answered recently
+func (u *Upstream) Healthy() bool {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return u.fails < UpstreamMaxFails
+}
+
+// RTT return the smoothed round trip time of the upstream, 0 when it never answered
+func (u *Upstream) RTT() time.Duration {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+
+	return u.rtt
+}
+
+func (f *Forwarder) incMetric(metricName string) {
+	if f.ms != nil {
+		f.ms.GetOrCreateAggregator(metricName, ms.Counter, false).(a.AggregatorCounter).Inc(1)
+	}
+}
+
+// ForwardZone is a conditional forwarding rule: the queries in the zone are forwarded to its own upstreams
+type ForwardZone struct {
+	Zone      string
+	Forwarder *Forwarder
+}
+
+// ParseForwardZones read the conditional forwarding rules with the format <zone>=<upstream>[,<upstream>...],
+// e.g: "corp.internal.=10.0.0.53,10.0.0.54" or "consul.=127.0.0.1:8600". The upstreams share the policy,
+// the transport and the timeout of the configuration. The rules are sorted from the most specific zone.
+func ParseForwardZones(config ForwardConfig, metricsService *a.MetricsService) ([]ForwardZone, error) {
+	forwardZones := []ForwardZone{}
+	zones := make(map[string]bool)
+
+	for _, rule := range config.Zones {
+		parts := strings.SplitN(rule, "=", 2)
+
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid forward zone %s, must be <zone>=<upstream>[,<upstream>...]", rule)
+		}
+
+		if _, ok := dns.IsDomainName(parts[0]); !ok {
+			return nil, fmt.Errorf("invalid zone of the forward zone %s", rule)
+		}
+
+		zone := utils.ToLowerFQDN(parts[0])
+
+		if zones[zone] {
+			return nil, fmt.Errorf("the zone %s is forwarded twice", zone)
+		}
+
+		zones[zone] = true
+
+		zoneConfig := config
+		zoneConfig.Upstreams = strings.Split(parts[1], ",")
+		forwarder, err := NewForwarder(zoneConfig, metricsService)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward zone %s: %s", rule, err)
+		}
+
+		forwardZones = append(forwardZones, ForwardZone{Zone: zone, Forwarder: forwarder})
+	}
+
+	sort.SliceStable(forwardZones, func(i, j int) bool {
+		return dns.CountLabel(forwardZones[i].Zone) > dns.CountLabel(forwardZones[j].Zone)
+	})
+
+	return forwardZones, nil
+}
+
+// resolverOf return the resolver of a name out of our zones: the forwarder of the longest forward zone
+// which contains the name, or the global resolver when there isn't any
+func (h *QuestionResolverHandler) resolverOf(qname string) RecursiveResolver {
+	for _, forwardZone := range h.forwardZones {
+		if dns.IsSubDomain(forwardZone.Zone, qname) {
+			return forwardZone.Forwarder
+		}
+	}
+
+	return h.resolver
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestShouldParseTheUpstreams(t *testing.T) {
+	config := ForwardConfig{Timeout: 500 * time.Millisecond}
+
+	tests := []struct {
+		raw        string
+		address    string
+		transport  string
+		timeout    time.Duration
+		serverName string
+	}{
+		{"9.9.9.9", "9.9.9.9:53", ForwardTransportUDP, 500 * time.Millisecond, ""},
+		{"tcp://10.0.0.53:5353", "10.0.0.53:5353", ForwardTransportTCP, 500 * time.Millisecond, ""},
+		{"tls://9.9.9.9?servername=dns.quad9.net&timeout=1s", "9.9.9.9:853", ForwardTransportTLS, time.Second, "dns.quad9.net"},
+		{"2001:db8::53", "[2001:db8::53]:53", ForwardTransportUDP, 500 * time.Millisecond, ""},
+		{"[2001:db8::53]:5353?timeout=100ms", "[2001:db8::53]:5353", ForwardTransportUDP, 100 * time.Millisecond, ""},
+	}
+
+	for _, test := range tests {
+		upstream, err := ParseUpstream(test.raw, config)
+
+		if assert.Nil(t, err, test.raw) {
+			assert.Equal(t, test.address, upstream.Address, test.raw)
+			assert.Equal(t, test.transport, upstream.Transport, test.raw)
+			assert.Equal(t, test.timeout, upstream.client.Timeout, test.raw)
+			assert.Equal(t, test.serverName, upstream.ServerName, test.raw)
+		}
+	}
+
+	_, err := ParseUpstream("https://9.9.9.9", config)
+	assert.NotNil(t, err)
+
+	_, err = ParseUpstream("9.9.9.9?timeout=fast", config)
+	assert.NotNil(t, err)
+
+	_, err = ParseForwardPolicy("random")
+	assert.NotNil(t, err)
+
+	_, err = NewForwarder(ForwardConfig{Upstreams: []string{"10.0.0.1"}, HealthCheckInterval: -time.Second}, nil)
+	assert.NotNil(t, err)
+}
+
+type ForwarderTestSuite struct {
+	suite.Suite
+	forwarder *Forwarder
+	mutex     sync.Mutex       // the health checks query the upstreams concurrently
+	queried   []string         // addresses of the upstreams queried
+	down      map[string]bool  // upstreams which don't answer
+	rtts      map[string]int64 // round trip times in milliseconds
+}
+
+func (suite *ForwarderTestSuite) SetupTest() {
+	suite.newForwarder(ForwardPolicySequential)
+}
+
+func (suite *ForwarderTestSuite) newForwarder(policy string) {
+	forwarder, err := NewForwarder(ForwardConfig{Upstreams: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, Policy: policy}, nil)
+	suite.Nil(err)
+
+	suite.queried = nil
+	suite.down = map[string]bool{}
+	suite.rtts = map[string]int64{}
+
+	forwarder.exchange = func(u *Upstream, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+		suite.mutex.Lock()
+		defer suite.mutex.Unlock()
+		suite.queried = append(suite.queried, u.Address)
+
+		if suite.down[u.Address] {
+			return nil, 0, fmt.Errorf("i/o timeout")
+		}
+
+		r := new(dns.Msg).SetReply(m)
+		r.Answer = []dns.RR{testRR(m.Question[0].Name + " 300 IN A 192.0.2.1")}
+		return r, time.Duration(suite.rtts[u.Address]) * time.Millisecond, nil
+	}
+
+	suite.forwarder = forwarder
+}
+
+func (suite *ForwarderTestSuite) TestShouldFallbackOnTheNextUpstream() {
+	suite.down["10.0.0.1:53"] = true
+
+	rrs, err := suite.forwarder.Resolve("example.com.", dns.TypeA)
+
+	suite.Nil(err)
+	suite.Len(rrs, 1)
+	suite.Equal([]string{"10.0.0.1:53", "10.0.0.2:53"}, suite.queried)
+}
+
+func (suite *ForwarderTestSuite) TestShouldFailWhenNoUpstreamAnswers() {
+	suite.down = map[string]bool{"10.0.0.1:53": true, "10.0.0.2:53": true, "10.0.0.3:53": true}
+
+	_, err := suite.forwarder.Resolve("example.com.", dns.TypeA)
+	suite.NotNil(err)
+}
+
+func (suite *ForwarderTestSuite) TestShouldTryTheUnhealthyUpstreamsLast() {
+	suite.down["10.0.0.1:53"] = true
+
+	for i := 0; i < UpstreamMaxFails; i++ {
+		suite.forwarder.checkHealth()
+	}
+
+	suite.False(suite.forwarder.upstreams[0].Healthy())
+
+	suite.queried = nil
+	suite.forwarder.Resolve("example.com.", dns.TypeA)
+	suite.Equal([]string{"10.0.0.2:53"}, suite.queried)
+
+	// The upstream comes back after a successful health check
+	suite.down["10.0.0.1:53"] = false
+	suite.forwarder.checkHealth()
+	suite.True(suite.forwarder.upstreams[0].Healthy())
+}
+
+func (suite *ForwarderTestSuite) TestShouldRotateTheUpstreamsWithTheRoundRobinPolicy() {
+	suite.newForwarder(ForwardPolicyRoundRobin)
+
+	for i := 0; i < 4; i++ {
+		suite.forwarder.Resolve("example.com.", dns.TypeA)
+	}
+
+	suite.Equal([]string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53", "10.0.0.1:53"}, suite.queried)
+}
+
+func (suite *ForwarderTestSuite) TestShouldPreferTheFastestUpstream() {
+	suite.newForwarder(ForwardPolicyFastest)
+	suite.rtts = map[string]int64{"10.0.0.1:53": 80, "10.0.0.2:53": 50, "10.0.0.3:53": 10}
+	suite.forwarder.checkHealth()
+
+	suite.queried = nil
+	suite.forwarder.Resolve("example.com.", dns.TypeA)
+	suite.Equal([]string{"10.0.0.3:53"}, suite.queried)
+}
+
+func (suite *ForwarderTestSuite) TestShouldAnswerWithTheRcodeAndTheAuthorityOfTheUpstream() {
+	soa := testRR("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")
+	rcodes := map[string]int{"www.example.com.": dns.RcodeSuccess, "ghost.example.com.": dns.RcodeNameError}
+
+	suite.forwarder.exchange = func(u *Upstream, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+		r := new(dns.Msg).SetRcode(m, rcodes[m.Question[0].Name])
+		r.Ns = []dns.RR{soa}
+		return r, 0, nil
+	}
+
+	handler := QuestionResolverHandler{resolver: suite.forwarder}
+
+	for qname, rcode := range rcodes {
+		msg := new(dns.Msg).SetQuestion(qname, dns.TypeAAAA)
+
+		suite.Equal(rcode, handler.answer(msg, msg.Question[0], true, false, "127.0.0.1", ""), qname)
+		suite.Empty(msg.Answer)
+		suite.Equal([]dns.RR{soa}, msg.Ns, "the SOA is kept for the negative caching")
+	}
+}
+
+func (suite *ForwarderTestSuite) TestShouldStopTheHealthChecks() {
+	suite.forwarder.healthCheckInterval = time.Millisecond
+	suite.forwarder.StartHealthChecks()
+	time.Sleep(20 * time.Millisecond)
+
+	suite.forwarder.Stop()
+	suite.forwarder.Stop()
+	time.Sleep(5 * time.Millisecond)
+
+	suite.mutex.Lock()
+	checks := len(suite.queried)
+	suite.mutex.Unlock()
+	suite.NotZero(checks)
+
+	time.Sleep(20 * time.Millisecond)
+
+	suite.mutex.Lock()
+	defer suite.mutex.Unlock()
+	suite.Equal(checks, len(suite.queried), "no health check after Stop")
+}
+
+func TestShouldRouteTheQueriesToTheLongestForwardZone(t *testing.T) {
+	config := ForwardConfig{Zones: []string{"internal.=10.0.0.1", "corp.internal.=10.0.0.2,tcp://10.0.0.3", "consul.=127.0.0.1:8600"}}
+	forwardZones, err := ParseForwardZones(config, nil)
+
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	resolver := NewResolver()
+	handler := QuestionResolverHandler{resolver: resolver, forwardZones: forwardZones}
+
+	tests := []struct {
+		qname     string
+		upstreams []string
+	}{
+		{"dc1.CORP.internal.", []string{"10.0.0.2:53", "10.0.0.3:53"}},
+		{"corp.internal.", []string{"10.0.0.2:53", "10.0.0.3:53"}},
+		{"www.internal.", []string{"10.0.0.1:53"}},
+		{"web.service.consul.", []string{"127.0.0.1:8600"}},
+	}
+
+	for _, test := range tests {
+		forwarder, ok := handler.resolverOf(test.qname).(*Forwarder)
+
+		if assert.True(t, ok, test.qname) {
+			addresses := []string{}
+
+			for _, upstream := range forwarder.upstreams {
+				addresses = append(addresses, upstream.Address)
+			}
+
+			assert.Equal(t, test.upstreams, addresses, test.qname)
+		}
+	}
+
+	assert.Equal(t, resolver, handler.resolverOf("notconsul."), "the other names are resolved with the global resolver")
+
+	for _, rule := range []string{"corp.internal.", "=10.0.0.1", "corp.internal.=", "corp.internal.=https://10.0.0.1"} {
+		_, err = ParseForwardZones(ForwardConfig{Zones: []string{rule}}, nil)
+		assert.NotNil(t, err, rule)
+	}
+
+	_, err = ParseForwardZones(ForwardConfig{Zones: []string{"consul=10.0.0.1", "Consul.=10.0.0.2"}}, nil)
+	assert.NotNil(t, err, "a zone is forwarded only once")
+}
+
+func TestForwarderTestSuite(t *testing.T) {
+	suite.Run(t, new(ForwarderTestSuite))
+}
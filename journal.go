@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+
+	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
+)
+
+// JournalBucket keeps the history of the changes applied by the consumer in each zone.
+// It's used to answer to the incremental zone transfers (IXFR). c.f RFC 1995
+var JournalBucket = []byte("journal")
+
+// MaxJournalVersions is the number of versions of a zone kept in the journal.
+// A secondary with an older version gets a full zone transfer.
+const MaxJournalVersions = 1000
+
+// JournalEntry is the difference between two versions of a zone, identified by the serial of their SOA.
+// The RRs are kept in the presentation format. The entry of the current version of
+// the zone has no ToSOA yet, it collects the changes until the next serial.
+type JournalEntry struct {
+	FromSOA string
+	ToSOA   string
+	Deleted []string
+	Added   []string
+}
+
+// journalKey return the key of the version of the zone with the format <zone>|<serial>.
+// The serial is in big endian to keep the versions ordered in the bucket.
+func journalKey(zone string, serial uint32) []byte {
+	key := make([]byte, len(dns.Fqdn(zone))+5)
+	copy(key, dns.Fqdn(zone)+"|")
+	binary.BigEndian.PutUint32(key[len(key)-4:], serial)
+	return key
+}
+
+func readJournalEntry(b *bolt.Bucket, key []byte) (entry JournalEntry, found bool, err error) {
+	raw := b.Get(key)
+
+	if raw == nil {
+		return
+	}
+
+	err = json.Unmarshal(raw, &entry)
+	return entry, err == nil, err
+}
+
+func writeJournalEntry(b *bolt.Bucket, key []byte, entry JournalEntry) error {
+	raw, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, raw)
+}
+
+// appendChangeToJournal record a change in the current version of the zone, soa is the current SOA of the zone
+func appendChangeToJournal(tx *bolt.Tx, zone string, soa *dns.SOA, deleted, added []dns.RR) error {
+	b, err := tx.CreateBucketIfNotExists(JournalBucket)
+
+	if err != nil {
+		return err
+	}
+
+	key := journalKey(zone, soa.Serial)
+	entry, _, err := readJournalEntry(b, key)
+
+	if err != nil {
+		return err
+	}
+
+	entry.FromSOA = soa.String()
+
+	for _, rr := range deleted {
+		entry.Deleted = append(entry.Deleted, rr.String())
+	}
+
+	for _, rr := range added {
+		entry.Added = append(entry.Added, rr.String())
+	}
+
+	return writeJournalEntry(b, key, entry)
+}
+
+// closeJournalVersion is called when the SOA of the zone changes: the current version
+// of the zone is closed and the next changes will be recorded in the version of the new serial.
+func closeJournalVersion(tx *bolt.Tx, zone string, oldSOA, newSOA *dns.SOA) error {
+	b, err := tx.CreateBucketIfNotExists(JournalBucket)
+
+	if err != nil {
+		return err
+	}
+
+	key := journalKey(zone, oldSOA.Serial)
+	entry, _, err := readJournalEntry(b, key)
+
+	if err != nil {
+		return err
+	}
+
+	entry.FromSOA = oldSOA.String()
+	entry.ToSOA = newSOA.String()
+
+	if err = writeJournalEntry(b, key, entry); err != nil {
+		return err
+	}
+
+	return pruneJournal(b, zone, newSOA.Serial)
+}
+
+// pruneJournal remove the oldest versions of the zone over MaxJournalVersions. The age of a version is the
+// distance from its serial to the current serial in the serial number arithmetic, so the latest versions
+// are kept after the serial wraps or jumps to a date or a timestamp. c.f RFC 1982
+func pruneJournal(b *bolt.Bucket, zone string, serial uint32) error {
+	prefix := []byte(dns.Fqdn(zone) + "|")
+	keys := [][]byte{}
+	c := b.Cursor()
+
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	if len(keys) <= MaxJournalVersions {
+		return nil
+	}
+
+	age := func(key []byte) uint32 {
+		return serial - binary.BigEndian.Uint32(key[len(key)-4:])
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return age(keys[i]) < age(keys[j]) })
+
+	for _, key := range keys[MaxJournalVersions:] {
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readJournalChain return the differences to go from the serial from to the serial to.
+// found is false if the journal doesn't have all the versions between them.
+func readJournalChain(db *bolt.DB, zone string, from, to uint32) (entries []JournalEntry, found bool) {
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(JournalBucket)
+
+		if b == nil {
+			return nil
+		}
+
+		serial := from
+
+		for len(entries) < MaxJournalVersions {
+			entry, exists, err := readJournalEntry(b, journalKey(zone, serial))
+
+			if err != nil || !exists || entry.ToSOA == "" {
+				return err
+			}
+
+			next, err := dns.NewRR(entry.ToSOA)
+
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, entry)
+			serial = next.(*dns.SOA).Serial
+
+			if serial == to {
+				found = true
+				return nil
+			}
+		}
+
+		return nil
+	})
+
+	return
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"testing"
 
+	"stream-dns/utils"
+
 	"github.com/google/uuid"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/suite"
@@ -27,7 +29,7 @@ func testRR(s string) dns.RR {
 }
 
 func testMarshalRR(rr []dns.RR) []byte {
-	rrRaw, err := json.Marshal(rr)
+	rrRaw, err := encodeRRs(rr)
 
 	if err != nil {
 		panic(err)
@@ -41,7 +43,7 @@ func (suite *DnsTestSuite) SetupTest() {
 	dbPath := fmt.Sprintf("/tmp/%s.db", uuid.New().String())
 	db, err := bolt.Open(dbPath, 0600, nil)
 
-	suite.handler = NewQuestionResolverHandler(db, DnsConfig{Zones: []string{".bar.services.com.", ".internal."}}, nil)
+	suite.handler = NewQuestionResolverHandler(db, nil, nil, DnsConfig{Zones: []string{".bar.services.com.", ".internal."}}, nil)
 
 	if err != nil {
 		suite.Fail("Can't create the bbolt database in /tmp/")
@@ -251,6 +253,78 @@ func (suite *DnsTestSuite) TestShouldFindAWildcardRecord() {
 	suite.Nil(err)
 }
 
+// The zone of the examples of RFC 4592 section 2.2.1
+func (suite *DnsTestSuite) seedWildcardZone() {
+	rrs := []dns.RR{
+		testRR("internal. 3600 IN SOA ns.internal. hostmaster.internal. 1 7200 3600 1209600 300"),
+		testRR("internal. 3600 IN NS ns.example.com."),
+		testRR("*.internal. 3600 IN TXT \"this is a wildcard\""),
+		testRR("*.internal. 3600 IN MX 10 host1.internal."),
+		testRR("sub.*.internal. 3600 IN TXT \"this is not a wildcard\""),
+		testRR("host1.internal. 3600 IN A 192.0.2.1"),
+		testRR("_ssh._tcp.host1.internal. 3600 IN SRV 0 0 22 host1.internal."),
+		testRR("_ssh._tcp.host2.internal. 3600 IN SRV 0 0 22 host2.internal."),
+		testRR("subdel.internal. 3600 IN NS ns.example.com."),
+	}
+
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(RecordBucket); err != nil {
+			suite.Fail("Can't seed the database")
+		} else {
+			for _, rr := range rrs {
+				putRRset(tx, utils.Key(rr.Header().Name, rr.Header().Rrtype), testMarshalRR([]dns.RR{rr}))
+			}
+		}
+
+		return nil
+	})
+}
+
+func (suite *DnsTestSuite) TestShouldSynthesizeTheWildcardsUnderTheClosestEncloser() {
+	suite.seedWildcardZone()
+
+	tests := []struct {
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer string
+	}{
+		{"host3.internal.", dns.TypeMX, dns.RcodeSuccess, "host3.internal.\t3600\tIN\tMX\t10 host1.internal."},
+		// The wildcard exists with other types
+		{"host3.internal.", dns.TypeA, dns.RcodeSuccess, ""},
+		// The wildcard matches more than one label
+		{"foo.bar.internal.", dns.TypeTXT, dns.RcodeSuccess, "foo.bar.internal.\t3600\tIN\tTXT\t\"this is a wildcard\""},
+		// The name exists, there is no synthesis
+		{"host1.internal.", dns.TypeMX, dns.RcodeSuccess, ""},
+		{"sub.*.internal.", dns.TypeMX, dns.RcodeSuccess, ""},
+		// The closest encloser is the empty non-terminal _tcp.host1.internal. which has no wildcard
+		{"_telnet._tcp.host1.internal.", dns.TypeSRV, dns.RcodeNameError, ""},
+		{"_tcp.host2.internal.", dns.TypeTXT, dns.RcodeSuccess, ""},
+		// The closest encloser is the wildcard itself, *.*.internal. doesn't exist
+		{"ghost.*.internal.", dns.TypeMX, dns.RcodeNameError, ""},
+		// The names below a delegation are never synthesized
+		{"host.subdel.internal.", dns.TypeTXT, dns.RcodeNameError, ""},
+	}
+
+	zoneCache, err := NewZoneCache(suite.handler.db)
+	suite.Nil(err)
+
+	for _, cache := range []*ZoneCache{nil, zoneCache} {
+		suite.handler.zoneCache = cache
+
+		for _, test := range tests {
+			rcode, rrs := suite.handler.resolveQuestion(dns.Question{Name: test.qname, Qtype: test.qtype, Qclass: dns.ClassINET}, true)
+			suite.Equal(test.rcode, rcode, test.qname)
+
+			if test.answer == "" {
+				suite.Empty(rrs, test.qname)
+			} else if suite.Len(rrs, 1, test.qname) {
+				suite.Equal(test.answer, rrs[0].String())
+			}
+		}
+	}
+}
+
 func (suite *DnsTestSuite) TestShouldReturnOnlyTheRecordWithoutTheWildcardWhenThePlainRecordExist() {
 	rrsExpected := make(map[string][]dns.RR)
 	key := "foo.bar.services.com.|A"
@@ -277,6 +351,114 @@ func (suite *DnsTestSuite) TestShouldReturnOnlyTheRecordWithoutTheWildcardWhenTh
 	suite.Nil(err)
 }
 
+func (suite *DnsTestSuite) TestShouldServeTheDNSKEYAtTheApexOfASignedZone() {
+	suite.handler.signer = &DnssecSigner{zones: map[string]*ZoneSigner{}}
+	suite.handler.signer.AddZoneSigner(testZoneSigner("internal."))
+
+	rrs, err := suite.handler.lookupRecord("internal.", dns.TypeDNSKEY, true, 0)
+	suite.Equal(2, len(rrs))
+	suite.Nil(err)
+}
+
+func (suite *DnsTestSuite) TestShouldListTheTypesOwnedByAName() {
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		if b, err := tx.CreateBucketIfNotExists(RecordBucket); err != nil {
+			suite.Fail("Can't seed the database")
+		} else {
+			b.Put([]byte("foo.internal.|A"), testMarshalRR([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")}))
+			b.Put([]byte("foo.internal.|TXT"), testMarshalRR([]dns.RR{testRR("foo.internal. 2700 IN TXT \"foo\"")}))
+			b.Put([]byte("www.foo.internal.|A"), testMarshalRR([]dns.RR{testRR("www.foo.internal. 2700 IN A 127.0.0.1")}))
+		}
+
+		return nil
+	})
+
+	suite.Equal([]uint16{dns.TypeA, dns.TypeTXT}, suite.handler.typesAtName("foo.internal."))
+	suite.Nil(suite.handler.typesAtName("bar.internal."))
+}
+
+func (suite *DnsTestSuite) TestShouldOnlyReturnTheRRsetOfTheQtype() {
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		if b, err := tx.CreateBucketIfNotExists(RecordBucket); err != nil {
+			suite.Fail("Can't seed the database")
+		} else {
+			b.Put([]byte("foo.internal.|A"), testMarshalRR([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")}))
+			b.Put([]byte("foo.internal.|AAAA"), testMarshalRR([]dns.RR{testRR("foo.internal. 2700 IN AAAA ::1")}))
+		}
+
+		return nil
+	})
+
+	rrs, err := suite.handler.lookupRecord("foo.internal.", dns.TypeA, true, 0)
+	suite.Equal(1, len(rrs))
+	suite.Equal(dns.TypeA, rrs[0].Header().Rrtype)
+	suite.Nil(err)
+}
+
+func (suite *DnsTestSuite) TestShouldAnswerNoDataWhenTheNameOnlyHasOtherTypes() {
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		if b, err := tx.CreateBucketIfNotExists(RecordBucket); err != nil {
+			suite.Fail("Can't seed the database")
+		} else {
+			b.Put([]byte("foo.internal.|A"), testMarshalRR([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")}))
+			b.Put([]byte("*.bar.services.com.|A"), testMarshalRR([]dns.RR{testRR("*.bar.services.com. 2700 IN A 127.0.0.1")}))
+		}
+
+		return nil
+	})
+
+	rcode, rrs := suite.handler.resolveQuestion(dns.Question{Name: "foo.internal.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, true)
+	suite.Equal(dns.RcodeSuccess, rcode)
+	suite.Equal(0, len(rrs))
+
+	rcode, rrs = suite.handler.resolveQuestion(dns.Question{Name: "foo.bar.services.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, true)
+	suite.Equal(dns.RcodeSuccess, rcode)
+	suite.Equal(0, len(rrs))
+
+	rcode, rrs = suite.handler.resolveQuestion(dns.Question{Name: "bar.internal.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}, true)
+	suite.Equal(dns.RcodeNameError, rcode)
+	suite.Equal(0, len(rrs))
+}
+
+func (suite *DnsTestSuite) TestShouldStoreAndFindAnyTypeOfRecord() {
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(RecordBucket)
+		return err
+	})
+
+	consumer := &KafkaConsumer{db: suite.handler.db, zones: suite.handler.config.Zones}
+
+	tests := []struct {
+		record Record
+		rr     string
+	}{
+		{Record{Name: "foo.internal.", Type: "MX", Content: "mail.internal.", Ttl: 300, Priority: 10}, "foo.internal.\t300\tIN\tMX\t10 mail.internal."},
+		{Record{Name: "_sip._tcp.internal.", Type: "SRV", Content: "10 5060 sip.internal.", Ttl: 300, Priority: 5}, "_sip._tcp.internal.\t300\tIN\tSRV\t5 10 5060 sip.internal."},
+		{Record{Name: "internal.", Type: "CAA", Content: "0 issue \"letsencrypt.org\"", Ttl: 300}, "internal.\t300\tIN\tCAA\t0 issue \"letsencrypt.org\""},
+		{Record{Name: "foo.internal.", Type: "SSHFP", Content: "4 2 123456789abcdef67890123456789abcdef67890123456789abcdef123456789", Ttl: 300}, "foo.internal.\t300\tIN\tSSHFP\t4 2 123456789ABCDEF67890123456789ABCDEF67890123456789ABCDEF123456789"},
+		{Record{Name: "_443._tcp.foo.internal.", Type: "TLSA", Content: "3 1 1 0c72ac70b745ac19998811b131d662c9ac69dbdbe7cb23e5b514b56664c5d3d6", Ttl: 300}, "_443._tcp.foo.internal.\t300\tIN\tTLSA\t3 1 1 0c72ac70b745ac19998811b131d662c9ac69dbdbe7cb23e5b514b56664c5d3d6"},
+		{Record{Name: "sub.internal.", Type: "DS", Content: "60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118", Ttl: 300}, "sub.internal.\t300\tIN\tDS\t60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118"},
+		{Record{Name: "foo.internal.", Type: "NAPTR", Content: "100 10 \"S\" \"SIP+D2U\" \"\" _sip._udp.internal.", Ttl: 300}, "foo.internal.\t300\tIN\tNAPTR\t100 10 \"S\" \"SIP+D2U\" \"\" _sip._udp.internal."},
+		{Record{Name: "foo.internal.", Type: "HTTPS", Content: "1 . alpn=\"h2,h3\" ipv4hint=\"192.0.2.1\"", Ttl: 300}, "foo.internal.\t300\tIN\tHTTPS\t1 . alpn=\"h2,h3\" ipv4hint=\"192.0.2.1\""},
+		{Record{Name: "_dns.internal.", Type: "SVCB", Content: "dns.internal. alpn=\"dot\" port=\"853\"", Ttl: 300, Priority: 1}, "_dns.internal.\t300\tIN\tSVCB\t1 dns.internal. alpn=\"dot\" port=\"853\""},
+		// The types unknown by the dns library are kept in the generic format of RFC 3597
+		{Record{Name: "foo.internal.", Type: "TYPE4242", Content: "\\# 3 000100", Ttl: 300}, "foo.internal.\t300\tCLASS1\tTYPE4242\t\\# 3 000100"},
+	}
+
+	for _, test := range tests {
+		rrs, err := MapRecordsIntoRRs([]Record{test.record})
+		suite.Nil(err, test.rr)
+
+		rtype := rrs[0].Header().Rrtype
+		suite.Nil(consumer.registerRecordAsBytesWithTheKeyInDB(utils.Key(test.record.Name, rtype), rrs, false))
+
+		found, err := suite.handler.lookupRecord(test.record.Name, rtype, true, 0)
+		suite.Nil(err)
+		suite.Equal(1, len(found), test.rr)
+		suite.Equal(test.rr, found[0].String())
+	}
+}
+
 func TestDnsTestSuite(t *testing.T) {
 	suite.Run(t, new(DnsTestSuite))
 }
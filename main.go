@@ -1,8 +1,7 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	a "stream-dns/agent"
@@ -51,6 +50,7 @@ func init() {
 	}
 
 	viper.SetEnvPrefix("DNS") // Avoid collisions with others env variables
+	viper.SetDefault("rrl_slip", DefaultRrlSlip)
 }
 
 var RecordBucket = []byte("records")
@@ -64,14 +64,19 @@ func main() {
 
 	db := setupRecordsDatabase(config.PathDB)
 	setupLocalRecords(db, config.LocalRecords, config.Dns.Zones)
+	zoneCache := setupZoneCache(db)
+	responseCache := NewResponseCache(config.Dns.ResponseCacheSize)
 
 	agent := setupMetricAgent(config.Agent, config.Statsd, instanceID)
 
 	metricsService := a.NewMetricsService(agent.Input, config.Agent.FlushInterval)
+	responseCache.ReportMetrics(&metricsService, config.Agent.FlushInterval)
 
-	setupKafkaConsumer(db, config.Kafka, &metricsService, config.DisallowCNAMEonAPEX)
+	notifier := setupNotifier(db, config.Dns, &metricsService)
 
-	setupDNSserveDNSr(db, config.Dns, &metricsService)
+	setupKafkaConsumer(db, config.Kafka, &metricsService, config.DisallowCNAMEonAPEX, config.Dns, notifier, zoneCache, responseCache)
+
+	setupDNSserveDNSr(db, zoneCache, responseCache, config.Dns, &metricsService)
 
 	setupHTTPAdministratorserveDNSr(db, config.Administrator)
 
@@ -95,9 +100,19 @@ func setupRecordsDatabase(path string) (db *bolt.DB) {
 			return err
 		}
 
-		return nil
+		_, err = tx.CreateBucketIfNotExists(JournalBucket)
+
+		return err
 	})
 
+	if err == nil {
+		err = migrateRecordsFormat(db)
+	}
+
+	if err == nil {
+		err = indexNames(db)
+	}
+
 	if err != nil {
 		log.Panic(err.Error())
 	}
@@ -116,6 +131,12 @@ func setupInstanceID(id string) string {
 }
 
 func getConfiguration() Config {
+	maxUdpSize, err := ParseMaxUdpSize(viper.GetInt("max_udp_size"))
+
+	if err != nil {
+		log.Panic(err)
+	}
+
 	return Config{
 		KafkaConfig{
 			Address:    viper.GetStringSlice("kafka_address"),
@@ -127,10 +148,71 @@ func getConfiguration() Config {
 			Mechanism:  viper.GetString("kafka_sasl_mechanism"),
 		},
 		DnsConfig{
-			viper.GetString("address"),
-			viper.GetBool("udp"),
-			viper.GetBool("tcp"),
-			viper.GetStringSlice("zones"),
+			Address:    viper.GetString("address"),
+			Udp:        viper.GetBool("udp"),
+			Tcp:        viper.GetBool("tcp"),
+			Zones:      viper.GetStringSlice("zones"),
+			MaxUdpSize: maxUdpSize,
+			Dnssec: DnssecConfig{
+				KeysDir:           viper.GetString("dnssec_keys_dir"),
+				SignatureValidity: viper.GetDuration("dnssec_signature_validity") * time.Hour,
+			},
+			Xfr: XfrConfig{
+				Allow:      viper.GetBool(ALLOW_AXFR),
+				AllowedIPs: viper.GetStringSlice("xfr_allowed_ips"),
+				TsigKeys:   viper.GetStringSlice("xfr_tsig_keys"),
+			},
+			Notify: NotifyConfig{
+				Secondaries: viper.GetStringSlice("notify_secondaries"),
+				Debounce:    viper.GetDuration("notify_debounce") * time.Millisecond,
+				MaxDelay:    viper.GetDuration("notify_max_delay") * time.Millisecond,
+				TsigKey:     viper.GetString("notify_tsig_key"),
+			},
+			Soa: SoaConfig{
+				SerialPolicy: viper.GetString("soa_serial_policy"),
+				Ns:           viper.GetString("soa_ns"),
+				Mbox:         viper.GetString("soa_mbox"),
+			},
+			TsigKeys: viper.GetStringSlice("tsig_keys"),
+			Forward: ForwardConfig{
+				Upstreams:           viper.GetStringSlice("resolver_address"),
+				Zones:               viper.GetStringSlice("resolver_forward_zones"),
+				Policy:              viper.GetString("resolver_policy"),
+				Transport:           viper.GetString("resolver_transport"),
+				Timeout:             viper.GetDuration("resolver_timeout") * time.Millisecond,
+				HealthCheckInterval: viper.GetDuration("resolver_health_check_interval") * time.Millisecond,
+			},
+			Recursion: RecursionConfig{
+				Mode:       viper.GetString("recursion_mode"),
+				AllowedIPs: viper.GetStringSlice("recursion_allowed_ips"),
+			},
+			Tls: TlsConfig{
+				Address:  viper.GetString("tls_address"),
+				CertFile: viper.GetString("tls_cert_file"),
+				KeyFile:  viper.GetString("tls_key_file"),
+			},
+			Doh: DohConfig{
+				Address:        viper.GetString("doh_address"),
+				Path:           viper.GetString("doh_path"),
+				TrustedProxies: viper.GetStringSlice("doh_trusted_proxies"),
+			},
+			Doq: DoqConfig{
+				Address:     viper.GetString("doq_address"),
+				IdleTimeout: viper.GetDuration("doq_idle_timeout") * time.Millisecond,
+				MaxStreams:  viper.GetInt("doq_max_streams"),
+				Allow0RTT:   viper.GetBool("doq_allow_0rtt"),
+			},
+			Rrl: RrlConfig{
+				ResponsesPerSecond: viper.GetInt("rrl_responses_per_second"),
+				NxdomainsPerSecond: viper.GetInt("rrl_nxdomains_per_second"),
+				ErrorsPerSecond:    viper.GetInt("rrl_errors_per_second"),
+				Slip:               viper.GetInt("rrl_slip"),
+				IPv4PrefixLength:   viper.GetInt("rrl_ipv4_prefix_length"),
+				IPv6PrefixLength:   viper.GetInt("rrl_ipv6_prefix_length"),
+				ExemptIPs:          viper.GetStringSlice("rrl_exempt_ips"),
+			},
+			Admission:         getAdmissionConfiguration(),
+			ResponseCacheSize: viper.GetInt("response_cache_size"),
 		},
 		AgentConfig{
 			viper.GetInt("metrics_buffer_size"),
@@ -154,6 +236,25 @@ func getConfiguration() Config {
 	}
 }
 
+// getAdmissionConfiguration read the ACLs of each listener, e.g: DNS_ACL_UDP_ALLOWED_IPS, DNS_ACL_TLS_DENIED_IPS
+func getAdmissionConfiguration() AdmissionConfig {
+	config := AdmissionConfig{
+		AllowedIPs:        make(map[string][]string),
+		DeniedIPs:         make(map[string][]string),
+		QueriesPerSecond:  viper.GetInt("client_queries_per_second"),
+		Burst:             viper.GetInt("client_burst"),
+		MaxTCPConnections: viper.GetInt("client_max_tcp_connections"),
+		Action:            viper.GetString("client_reject_action"),
+	}
+
+	for _, listener := range Listeners {
+		config.AllowedIPs[listener] = viper.GetStringSlice("acl_" + listener + "_allowed_ips")
+		config.DeniedIPs[listener] = viper.GetStringSlice("acl_" + listener + "_denied_ips")
+	}
+
+	return config
+}
+
 func setupLocalRecords(db *bolt.DB, rawLocalRecords string, zones []string) {
 	if rawLocalRecords != "" {
 		localRecords, err := localARecordsRawIntoRecords(rawLocalRecords, zones)
@@ -188,8 +289,28 @@ func setupMetricAgent(cfg AgentConfig, statsdCfg StatsdConfig, instanceID string
 	return
 }
 
-func setupKafkaConsumer(db *bolt.DB, cfg KafkaConfig, metricsService *a.MetricsService, disallowCnameOnAPEX bool) {
-	kafkaConsumer, err := NewKafkaConsumer(cfg, db, metricsService)
+func setupNotifier(db *bolt.DB, cfg DnsConfig, metricsService *a.MetricsService) *Notifier {
+	notifier, err := NewNotifier(db, cfg, metricsService)
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return notifier
+}
+
+func setupZoneCache(db *bolt.DB) *ZoneCache {
+	zoneCache, err := NewZoneCache(db)
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return zoneCache
+}
+
+func setupKafkaConsumer(db *bolt.DB, cfg KafkaConfig, metricsService *a.MetricsService, disallowCnameOnAPEX bool, dnsConfig DnsConfig, notifier *Notifier, zoneCache *ZoneCache, responseCache *ResponseCache) {
+	kafkaConsumer, err := NewKafkaConsumer(cfg, db, metricsService, dnsConfig, notifier, zoneCache, responseCache)
 
 	if err != nil {
 		log.Panic(err)
@@ -199,26 +320,70 @@ func setupKafkaConsumer(db *bolt.DB, cfg KafkaConfig, metricsService *a.MetricsS
 	go kafkaConsumer.Run(disallowCnameOnAPEX)
 }
 
-func setupDNSserveDNSr(db *bolt.DB, cfg DnsConfig, metricsService *a.MetricsService) {
-	go serveDNS(db, cfg, metricsService)
+func setupDNSserveDNSr(db *bolt.DB, zoneCache *ZoneCache, responseCache *ResponseCache, cfg DnsConfig, metricsService *a.MetricsService) {
+	go serveDNS(db, zoneCache, responseCache, cfg, metricsService)
 }
 
-func serveDNS(db *bolt.DB, config DnsConfig, metricsService *a.MetricsService) {
-	handler := NewQuestionResolverHandler(db, config, metricsService)
+func serveDNS(db *bolt.DB, zoneCache *ZoneCache, responseCache *ResponseCache, config DnsConfig, metricsService *a.MetricsService) {
+	handler := NewQuestionResolverHandler(db, zoneCache, responseCache, config, metricsService)
 
 	if config.Udp {
-		serverudp := &dns.Server{Addr: config.Address, Net: "udp", TsigSecret: nil}
-		serverudp.Handler = &handler
+		serverudp := &dns.Server{Addr: config.Address, Net: "udp", TsigSecret: handler.TsigSecret(), MsgAcceptFunc: acceptQueryFunc}
+		serverudp.Handler = handler.ListenerHandler(ListenerUDP)
 		go serverudp.ListenAndServe()
 		log.WithField("address", config.Address).Info("UDP serveDNS listening")
 	}
 
 	if config.Tcp {
-		servertcp := &dns.Server{Addr: config.Address, Net: "tcp", TsigSecret: nil}
-		servertcp.Handler = &handler
-		go servertcp.ListenAndServe()
+		listener, err := net.Listen("tcp", config.Address)
+
+		if err != nil {
+			log.WithField("address", config.Address).Panic(err)
+		}
+
+		servertcp := &dns.Server{Listener: handler.limitConnections(listener), Net: "tcp", TsigSecret: handler.TsigSecret(), MsgAcceptFunc: acceptQueryFunc}
+		servertcp.Handler = handler.ListenerHandler(ListenerTCP)
+		go servertcp.ActivateAndServe()
 		log.WithField("address", config.Address).Info("TCP serveDNS listening")
 	}
+
+	if config.Tls.Address != "" {
+		servertls, err := newDotServer(&handler, config.Tls)
+
+		if err != nil {
+			log.WithField("address", config.Tls.Address).Panic(err)
+		}
+
+		go servertls.ActivateAndServe()
+		log.WithField("address", config.Tls.Address).Info("DNS over TLS serveDNS listening")
+	}
+
+	if config.Doh.Address != "" {
+		serverdoh, err := NewDohServer(&handler, config.Doh)
+
+		if err != nil {
+			log.WithField("trusted-proxies", config.Doh.TrustedProxies).Panic(err)
+		}
+
+		go func() {
+			if err := serverdoh.Start(config.Doh, config.Tls); err != nil {
+				log.WithField("address", config.Doh.Address).Error(err)
+			}
+		}()
+
+		log.WithField("address", config.Doh.Address).Info("DNS over HTTPS serveDNS listening")
+	}
+
+	if config.Doq.Address != "" {
+		serverdoq, err := NewDoqServer(&handler, config.Doq, config.Tls)
+
+		if err != nil {
+			log.WithField("address", config.Doq.Address).Panic(err)
+		}
+
+		go serverdoq.Serve()
+		log.WithField("address", config.Doq.Address).Info("DNS over QUIC serveDNS listening")
+	}
 }
 
 func setupHTTPAdministratorserveDNSr(db *bolt.DB, cfg AdministratorConfig) {
@@ -226,17 +391,17 @@ func setupHTTPAdministratorserveDNSr(db *bolt.DB, cfg AdministratorConfig) {
 	go httpAdministrator.StartHttpAdministrator()
 }
 
-// FIXME: For now, the local-records can only accept A Rtype DNS record
-// we can improve this to accept any type of Rtype and improve the parsing.
+// registerLocalRecords save the local records in the bbolt database, grouped by RRset
 func registerLocalRecords(db *bolt.DB, records []dns.RR) error {
 	tmp := make(map[string][]dns.RR)
 
 	for _, rr := range records {
-		tmp[fmt.Sprintf("%s|%s", dns.Fqdn(rr.Header().Name), dns.TypeToString[rr.Header().Rrtype])] = []dns.RR{rr}
+		key := string(utils.Key(rr.Header().Name, rr.Header().Rrtype))
+		tmp[key] = append(tmp[key], rr)
 	}
 
 	for key, r := range tmp {
-		recordRaw, err := json.Marshal(r)
+		recordRaw, err := encodeRRs(r)
 
 		if err != nil {
 			return err
@@ -245,9 +410,9 @@ func registerLocalRecords(db *bolt.DB, records []dns.RR) error {
 		keyRaw := []byte(key)
 
 		err = db.Update(func(tx *bolt.Tx) error {
-			b, _ := tx.CreateBucketIfNotExists(RecordBucket)
+			tx.CreateBucketIfNotExists(RecordBucket)
 
-			err := b.Put(keyRaw, recordRaw)
+			err := putRRset(tx, keyRaw, recordRaw)
 
 			if err != nil {
 				return err
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	a "stream-dns/agent"
+	ms "stream-dns/metrics"
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// NOTIFY configuration. c.f RFC 1996
+const (
+	DefaultNotifyDebounce = 2000 * time.Millisecond
+	// Maximum delay between a change and its NOTIFY, so a steady stream of changes doesn't delay it forever
+	DefaultNotifyMaxDelay = 30000 * time.Millisecond
+	NotifyTimeout         = 2000 * time.Millisecond
+	NotifyMaxRetries      = 5
+	NotifyInitialBackoff  = 1000 * time.Millisecond
+)
+
+// Notifier tells the secondaries that a zone has changed, so they transfer it without waiting for the refresh of the SOA.
+// The changes are debounced: a burst of records consumed in a zone produces only one NOTIFY,
+// sent at the latest maxDelay after the first change of the burst.
+type Notifier struct {
+	db          *bolt.DB
+	secondaries map[string][]string // addresses of the secondaries, indexed by zone
+	debounce    time.Duration
+	maxDelay    time.Duration
+	backoff     time.Duration // first delay between two retries, doubled after each retry
+	tsigKey     *TsigKey
+	ms          *a.MetricsService
+	mutex       sync.Mutex
+	pending     map[string]*pendingNotify // zones changed since their last NOTIFY
+	exchange    func(m *dns.Msg, address string) (*dns.Msg, error)
+}
+
+// pendingNotify is the NOTIFY of a zone waiting for the end of the burst of changes
+type pendingNotify struct {
+	timer    *time.Timer
+	deadline time.Time // the NOTIFY isn't delayed after it
+}
+
+// NewNotifier create a Notifier for the secondaries of the configuration, it returns nil when there isn't any secondary
+func NewNotifier(db *bolt.DB, config DnsConfig, metricsService *a.MetricsService) (*Notifier, error) {
+	secondaries, err := ParseNotifySecondaries(config.Notify.Secondaries, config.Zones)
+
+	if err != nil || len(secondaries) == 0 {
+		return nil, err
+	}
+
+	notifier := &Notifier{
+		db:          db,
+		secondaries: secondaries,
+		debounce:    config.Notify.Debounce,
+		maxDelay:    config.Notify.MaxDelay,
+		backoff:     NotifyInitialBackoff,
+		ms:          metricsService,
+		pending:     make(map[string]*pendingNotify),
+	}
+
+	if notifier.debounce <= 0 {
+		notifier.debounce = DefaultNotifyDebounce
+	}
+
+	if notifier.maxDelay <= 0 {
+		notifier.maxDelay = DefaultNotifyMaxDelay
+	}
+
+	client := &dns.Client{Net: "udp", Timeout: NotifyTimeout}
+
+	if config.Notify.TsigKey != "" {
+		keys, err := ParseTsigKeys(config.TsigKeys)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key, found := keys[utils.ToLowerFQDN(config.Notify.TsigKey)]
+
+		if !found {
+			return nil, fmt.Errorf("the TSIG key %s used to sign the NOTIFY isn't in the keyring", config.Notify.TsigKey)
+		}
+
+		notifier.tsigKey = &key
+		client.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+
+	notifier.exchange = func(m *dns.Msg, address string) (*dns.Msg, error) {
+		r, _, err := client.Exchange(m, address)
+		return r, err
+	}
+
+	return notifier, nil
+}
+
+// ParseNotifySecondaries read the secondaries of the configuration, with the format <zone>=<address>
+// for the secondary of one zone, or <address> for a secondary of all the zones. The port is 53 by default.
+func ParseNotifySecondaries(rawSecondaries []string, zones []string) (map[string][]string, error) {
+	secondaries := make(map[string][]string)
+
+	for _, raw := range rawSecondaries {
+		targetZones := zones
+		address := raw
+
+		if parts := strings.SplitN(raw, "=", 2); len(parts) == 2 {
+			apex, found := utils.FindZone(utils.ToLowerFQDN(parts[0]), zones)
+
+			if !found || apex != utils.ToLowerFQDN(parts[0]) {
+				return nil, fmt.Errorf("the zone %s of the secondary %s isn't managed", parts[0], parts[1])
+			}
+
+			targetZones = []string{apex}
+			address = parts[1]
+		}
+
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid address of secondary %s", raw)
+		}
+
+		for _, zone := range targetZones {
+			apex := utils.ZoneApex(zone)
+			secondaries[apex] = append(secondaries[apex], address)
+		}
+	}
+
+	return secondaries, nil
+}
+
+// ZoneChanged is called by the consumer for each record registered in the zone.
+// The NOTIFY is sent when no other change happened in the zone during the debounce delay,
+// or when the maximum delay since the first change is reached.
+func (n *Notifier) ZoneChanged(zone string) {
+	if n == nil || len(n.secondaries[zone]) == 0 {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+
+	if pending, found := n.pending[zone]; found {
+		delay := n.debounce
+
+		if untilDeadline := pending.deadline.Sub(now); untilDeadline < delay {
+			delay = untilDeadline
+		}
+
+		pending.timer.Reset(delay)
+		return
+	}
+
+	pending := &pendingNotify{deadline: now.Add(n.maxDelay)}
+	pending.timer = time.AfterFunc(n.debounce, func() {
+		n.mutex.Lock()
+
+		// The timer was reset while it fired, the NOTIFY was already sent with the last change
+		if n.pending[zone] != pending {
+			n.mutex.Unlock()
+			return
+		}
+
+		delete(n.pending, zone)
+		n.mutex.Unlock()
+
+		n.notifyZone(zone)
+	})
+
+	n.pending[zone] = pending
+}
+
+// notifyZone send the NOTIFY with the current SOA of the zone to all its secondaries
+func (n *Notifier) notifyZone(zone string) {
+	var soa *dns.SOA
+
+	n.db.View(func(tx *bolt.Tx) error {
+		soa = readSOA(tx, zone)
+		return nil
+	})
+
+	if soa == nil {
+		log.WithField("zone", zone).Warn("Can't notify the secondaries of a zone without SOA")
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for _, address := range n.secondaries[zone] {
+		wg.Add(1)
+
+		go func(address string) {
+			defer wg.Done()
+			n.notifySecondary(zone, soa, address)
+		}(address)
+	}
+
+	wg.Wait()
+}
+
+// notifySecondary send the NOTIFY to the secondary and retry with an exponential backoff while it doesn't answer
+func (n *Notifier) notifySecondary(zone string, soa *dns.SOA, address string) {
+	logger := log.WithFields(log.Fields{"zone": zone, "serial": soa.Serial, "secondary": address})
+	backoff := n.backoff
+
+	for attempt := 0; attempt <= NotifyMaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		m := new(dns.Msg).SetNotify(zone)
+		m.Authoritative = true
+		m.Answer = []dns.RR{soa}
+
+		if n.tsigKey != nil {
+			m.SetTsig(n.tsigKey.Name, n.tsigKey.Algorithm, TsigFudge, time.Now().Unix())
+		}
+
+		r, err := n.exchange(m, address)
+
+		if err != nil {
+			logger.WithError(err).WithField("attempt", attempt+1).Warn("The secondary didn't answer to the NOTIFY")
+			continue
+		}
+
+		if r.Rcode != dns.RcodeSuccess {
+			logger.WithField("rcode", dns.RcodeToString[r.Rcode]).Error("The secondary rejected the NOTIFY")
+			n.incMetric("notify-failed")
+			return
+		}
+
+		logger.Info("Notified the secondary")
+		n.incMetric("notify-sent")
+		return
+	}
+
+	logger.Error("Gave up notifying the secondary")
+	n.incMetric("notify-failed")
+}
+
+func (n *Notifier) incMetric(metricName string) {
+	if n.ms != nil {
+		n.ms.GetOrCreateAggregator(metricName, ms.Counter, false).(a.AggregatorCounter).Inc(1)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+)
+
+type NotifierTestSuite struct {
+	suite.Suite
+	consumer *KafkaConsumer
+	notifier *Notifier
+	mutex    sync.Mutex
+	notifies []*dns.Msg
+	failures int // number of NOTIFY to lose before the secondary answers
+}
+
+func (suite *NotifierTestSuite) SetupTest() {
+	db := newTestDB()
+
+	config := DnsConfig{
+		Zones:  []string{"internal."},
+		Notify: NotifyConfig{Secondaries: []string{"internal.=127.0.0.1:5353", "127.0.0.2"}, Debounce: 50 * time.Millisecond},
+	}
+
+	var err error
+	suite.notifier, err = NewNotifier(db, config, nil)
+	suite.Nil(err)
+
+	suite.notifies = nil
+	suite.failures = 0
+	suite.notifier.backoff = time.Millisecond
+	suite.notifier.exchange = func(m *dns.Msg, address string) (*dns.Msg, error) {
+		suite.mutex.Lock()
+		defer suite.mutex.Unlock()
+
+		suite.notifies = append(suite.notifies, m)
+
+		if suite.failures > 0 {
+			suite.failures--
+			return nil, fmt.Errorf("timeout")
+		}
+
+		return new(dns.Msg).SetReply(m), nil
+	}
+
+	suite.consumer = &KafkaConsumer{db: db, zones: config.Zones, notifier: suite.notifier}
+	suite.register("internal.|SOA", testRR("internal. 3600 IN SOA ns.internal. admin.internal. 1 7200 3600 1209600 300"))
+	suite.waitNotifies(2)
+	suite.notifies = nil
+}
+
+func (suite *NotifierTestSuite) TearDownTest() {
+	closeTestDB(suite.consumer.db)
+}
+
+func (suite *NotifierTestSuite) register(key string, rrs ...dns.RR) {
+	suite.Nil(suite.consumer.registerRecordAsBytesWithTheKeyInDB([]byte(key), rrs, false))
+}
+
+// waitNotifies wait until the secondaries got count NOTIFY
+func (suite *NotifierTestSuite) waitNotifies(count int) {
+	suite.Eventually(func() bool {
+		suite.mutex.Lock()
+		defer suite.mutex.Unlock()
+		return len(suite.notifies) >= count
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (suite *NotifierTestSuite) TestShouldParseTheSecondaries() {
+	secondaries, err := ParseNotifySecondaries([]string{"foo.internal.=10.0.0.1", "[::1]:5353"}, []string{"internal.", "foo.internal."})
+
+	suite.Nil(err)
+	suite.Equal([]string{"10.0.0.1:53", "[::1]:5353"}, secondaries["foo.internal."])
+	suite.Equal([]string{"[::1]:5353"}, secondaries["internal."])
+
+	_, err = ParseNotifySecondaries([]string{"example.com.=10.0.0.1"}, []string{"internal."})
+	suite.NotNil(err)
+}
+
+func (suite *NotifierTestSuite) TestShouldSendOneNotifyForABurstOfChanges() {
+	for i := 0; i < 10; i++ {
+		suite.register("foo.internal.|A", testRR(fmt.Sprintf("foo.internal. 2700 IN A 127.0.0.%d", i)))
+	}
+
+	suite.waitNotifies(2)
+	time.Sleep(100 * time.Millisecond)
+
+	suite.Equal(2, len(suite.notifies))
+
+	for _, m := range suite.notifies {
+		suite.Equal(dns.OpcodeNotify, m.Opcode)
+		suite.Equal("internal.", m.Question[0].Name)
+		suite.Equal(uint32(11), m.Answer[0].(*dns.SOA).Serial)
+	}
+}
+
+func (suite *NotifierTestSuite) TestShouldRetryTheNotifyWhenTheSecondaryDoesNotAnswer() {
+	suite.notifier.secondaries["internal."] = []string{"127.0.0.1:5353"}
+	suite.failures = 2
+
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.1"))
+
+	suite.waitNotifies(3)
+	time.Sleep(100 * time.Millisecond)
+
+	suite.Equal(3, len(suite.notifies))
+}
+
+func (suite *NotifierTestSuite) TestShouldNotifyAfterTheMaximumDelayWhenTheZoneKeepsChanging() {
+	suite.notifier.maxDelay = 150 * time.Millisecond
+
+	// The zone changes faster than the debounce delay
+	for i, start := 0, time.Now(); time.Since(start) < 300*time.Millisecond; i++ {
+		suite.register("foo.internal.|A", testRR(fmt.Sprintf("foo.internal. 2700 IN A 127.0.0.%d", i%250)))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	suite.mutex.Lock()
+	defer suite.mutex.Unlock()
+	suite.NotEmpty(suite.notifies)
+}
+
+func TestNotifierTestSuite(t *testing.T) {
+	suite.Run(t, new(NotifierTestSuite))
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 
+	"stream-dns/utils"
+
 	dns "github.com/miekg/dns"
 )
 
@@ -25,22 +27,6 @@ type Record struct {
 	Metadatas Metadatas `json:",omitempty"`
 }
 
-func A(rr string) *dns.A { r, _ := dns.NewRR(rr); return r.(*dns.A) }
-
-func AAAA(rr string) *dns.AAAA { r, _ := dns.NewRR(rr); return r.(*dns.AAAA) }
-
-func CNAME(rr string) *dns.CNAME { r, _ := dns.NewRR(rr); return r.(*dns.CNAME) }
-
-func SOA(rr string) *dns.SOA { r, _ := dns.NewRR(rr); return r.(*dns.SOA) }
-
-func MX(rr string) *dns.MX { r, _ := dns.NewRR(rr); return r.(*dns.MX) }
-
-func NS(rr string) *dns.NS { r, _ := dns.NewRR(rr); return r.(*dns.NS) }
-
-func TXT(rr string) *dns.TXT { r, _ := dns.NewRR(rr); return r.(*dns.TXT) }
-
-func PTR(rr string) *dns.PTR { r, _ := dns.NewRR(rr); return r.(*dns.PTR) }
-
 func recordToString(record Record) string {
 	if record.Priority > 0 {
 		return fmt.Sprintf("%s %d IN %s %d %s", record.Name, record.Ttl, record.Type, record.Priority, record.Content)
@@ -49,43 +35,38 @@ func recordToString(record Record) string {
 	}
 }
 
-// - The primary name server for the domain
-// - The responsible party for the domain
-// - A timestamp that changes whenever you update your domain.
-// - The number of seconds before the zone should be refreshed.
-// - The number of seconds before a failed refresh should be retried.
-// - The upper limit in seconds before a zone is considered no longer authoritative.
-// - The negative result TTL
-func recordSOAToString(record Record) string {
-	return fmt.Sprintf("%s %d IN SOA %s", record.Name, record.Ttl, record.Content)
+// Types which can't be produced: the meta types of the protocol and the DNSSEC
+// records, which are generated by the online signing.
+var unsupportedRecordTypes = map[uint16]bool{
+	dns.TypeOPT:   true,
+	dns.TypeTSIG:  true,
+	dns.TypeTKEY:  true,
+	dns.TypeAXFR:  true,
+	dns.TypeIXFR:  true,
+	dns.TypeMAILA: true,
+	dns.TypeMAILB: true,
+	dns.TypeANY:   true,
+	dns.TypeRRSIG: true,
+	dns.TypeNSEC:  true,
+	dns.TypeNSEC3: true,
 }
 
 // RecordToRR converts a Record to a dns.RR.
-// If the RR is not a type that this package uses,
-// it returns a nil RR.
+// The Content is the RDATA in the presentation format of the type, e.g: "10 5060 sip.example.com." for a SRV
+// when the priority isn't given apart, or "1 . alpn=h2" for a HTTPS. The types unknown by the dns library
+// use the generic format of RFC 3597, e.g: "\# 3 000100".
+// If the RR can't be parsed or its type can't be produced, it returns a nil RR.
 func RecordToRR(record Record) dns.RR {
-	var rr dns.RR
-	rtype := dns.StringToType[record.Type]
-	recordstr := recordToString(record)
-
-	switch rtype {
-	case dns.TypeA:
-		rr = A(recordstr)
-	case dns.TypeAAAA:
-		rr = AAAA(recordstr)
-	case dns.TypeCNAME:
-		rr = CNAME(recordstr)
-	case dns.TypeSOA:
-		rr = SOA(recordSOAToString(record))
-	case dns.TypeMX:
-		rr = MX(recordstr)
-	case dns.TypeNS:
-		rr = NS(recordstr)
-	case dns.TypeTXT:
-		rr = TXT(recordstr)
-	case dns.TypePTR:
-		rr = PTR(recordstr)
-	default:
+	rtype, found := utils.StringToType(record.Type)
+
+	if !found || unsupportedRecordTypes[rtype] {
+		return nil
+	}
+
+	record.Type = dns.Type(rtype).String()
+	rr, err := dns.NewRR(recordToString(record))
+
+	if err != nil {
 		return nil
 	}
 
@@ -95,7 +76,13 @@ func RecordToRR(record Record) dns.RR {
 // Convert slice of Record into a  slice of dns.RR
 func MapRecordsIntoRRs(records []Record) (rrs []dns.RR, err error) {
 	for _, r := range records {
-		rrs = append(rrs, RecordToRR(r))
+		rr := RecordToRR(r)
+
+		if rr == nil {
+			return nil, fmt.Errorf("can't convert the record %s %s %s into a RR", r.Name, r.Type, r.Content)
+		}
+
+		rrs = append(rrs, rr)
 	}
 
 	return
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldRefuseTheRecordsWhichCantBeProduced(t *testing.T) {
+	for _, record := range []Record{
+		{Name: "foo.internal.", Type: "FOO", Content: "127.0.0.1", Ttl: 300},
+		{Name: "foo.internal.", Type: "A", Content: "not an ip", Ttl: 300},
+		{Name: "foo.internal.", Type: "RRSIG", Content: "A 8 2 300 20200101000000 20190101000000 42 internal. AAAA", Ttl: 300},
+		{Name: "foo.internal.", Type: "OPT", Content: "", Ttl: 300},
+	} {
+		assert.Nil(t, RecordToRR(record), record.Type)
+
+		_, err := MapRecordsIntoRRs([]Record{record})
+		assert.NotNil(t, err, record.Type)
+	}
+}
+
+func TestShouldConvertARecordWithALowercaseType(t *testing.T) {
+	rr := RecordToRR(Record{Name: "foo.internal.", Type: "aaaa", Content: "::1", Ttl: 300})
+
+	assert.NotNil(t, rr)
+	assert.Equal(t, "foo.internal.\t300\tIN\tAAAA\t::1", rr.String())
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"stream-dns/utils"
+)
+
+// Modes of the server, which decide if the queries out of our zones are resolved
+const (
+	RecursionModeAuthoritative = "authoritative" // only our zones are answered, the server is never a resolver
+	RecursionModeRecursive     = "recursive"     // all the queries are answered, only to the clients allowed to recurse
+	RecursionModeBoth          = "both"          // our zones are answered to everyone, the other names only to the clients allowed to recurse
+)
+
+// ParseRecursionMode check the mode of the configuration, the server is both authoritative and recursive by default
+func ParseRecursionMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return RecursionModeBoth, nil
+	case RecursionModeAuthoritative, RecursionModeRecursive, RecursionModeBoth:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown recursion mode %s, must be one of %s, %s or %s", mode, RecursionModeAuthoritative, RecursionModeRecursive, RecursionModeBoth)
+	}
+}
+
+// recursionAllowed look if the client may ask the names out of our zones
+func (h *QuestionResolverHandler) recursionAllowed(remoteAddr net.Addr) bool {
+	if h.recursionMode == RecursionModeAuthoritative {
+		return false
+	}
+
+	return utils.ContainsIP(h.recursionACL, utils.IPFromAddr(remoteAddr))
+}
+
+// queryAllowed look if the client may ask the qname: a client which isn't allowed to recurse only gets
+// the answers of our zones, and nothing at all from a recursive server
+func (h *QuestionResolverHandler) queryAllowed(qname string, recursion bool) bool {
+	if recursion {
+		return true
+	}
+
+	return h.recursionMode != RecursionModeRecursive && h.isALocalRecord(qname)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testResolver answers all the names out of our zones with the same address
+type testResolver struct {
+	queries int
+}
+
+func (r *testResolver) Resolve(qname string, qtype uint16) ([]dns.RR, error) {
+	r.queries++
+	return []dns.RR{testRR(qname + " 300 IN A 192.0.2.1")}, nil
+}
+
+type RecursionTestSuite struct {
+	suite.Suite
+	db       *bolt.DB
+	resolver *testResolver
+}
+
+func (suite *RecursionTestSuite) SetupTest() {
+	suite.db = newTestDB(
+		[]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")},
+		[]dns.RR{testRR("www.internal. 2700 IN CNAME www.example.com.")},
+	)
+	suite.resolver = &testResolver{}
+}
+
+func (suite *RecursionTestSuite) TearDownTest() {
+	closeTestDB(suite.db)
+}
+
+func (suite *RecursionTestSuite) newHandler(mode string, allowedIPs ...string) QuestionResolverHandler {
+	config := DnsConfig{Zones: []string{"internal."}, Recursion: RecursionConfig{Mode: mode, AllowedIPs: allowedIPs}}
+	handler := NewQuestionResolverHandler(suite.db, nil, nil, config, nil)
+	handler.resolver = suite.resolver
+
+	return handler
+}
+
+// query ask the qname from the client, 127.0.0.1 or 192.0.2.53
+func (suite *RecursionTestSuite) query(handler QuestionResolverHandler, ip string, qname string) *dns.Msg {
+	w := newTestUDPResponseWriter()
+	w.remoteAddr = &net.UDPAddr{IP: net.ParseIP(ip), Port: 4242}
+	handler.ServeDNS(w, new(dns.Msg).SetQuestion(qname, dns.TypeA))
+
+	return w.msg
+}
+
+func (suite *RecursionTestSuite) TestShouldRefuseTheRecursionInTheAuthoritativeMode() {
+	handler := suite.newHandler(RecursionModeAuthoritative)
+
+	msg := suite.query(handler, "127.0.0.1", "www.example.com.")
+	suite.Equal(dns.RcodeRefused, msg.Rcode)
+	suite.False(msg.RecursionAvailable)
+
+	msg = suite.query(handler, "127.0.0.1", "foo.internal.")
+	suite.Equal(dns.RcodeSuccess, msg.Rcode)
+	suite.True(msg.Authoritative)
+	suite.False(msg.RecursionAvailable)
+	suite.Len(msg.Answer, 1)
+
+	msg = suite.query(handler, "127.0.0.1", "www.internal.")
+	suite.Len(msg.Answer, 1, "the target of the CNAME out of our zones isn't resolved")
+	suite.Zero(suite.resolver.queries)
+}
+
+func (suite *RecursionTestSuite) TestShouldOnlyRecurseForTheAllowedClients() {
+	handler := suite.newHandler(RecursionModeBoth, "127.0.0.0/8")
+
+	msg := suite.query(handler, "127.0.0.1", "www.example.com.")
+	suite.Equal(dns.RcodeSuccess, msg.Rcode)
+	suite.True(msg.RecursionAvailable)
+	suite.Len(msg.Answer, 1)
+
+	msg = suite.query(handler, "127.0.0.1", "www.internal.")
+	suite.True(msg.RecursionAvailable)
+	suite.Len(msg.Answer, 2)
+
+	msg = suite.query(handler, "192.0.2.53", "www.example.com.")
+	suite.Equal(dns.RcodeRefused, msg.Rcode)
+	suite.False(msg.RecursionAvailable)
+
+	msg = suite.query(handler, "192.0.2.53", "foo.internal.")
+	suite.Equal(dns.RcodeSuccess, msg.Rcode)
+	suite.False(msg.RecursionAvailable)
+	suite.Len(msg.Answer, 1)
+}
+
+func (suite *RecursionTestSuite) TestShouldRefuseAllTheQueriesOfTheOtherClientsInTheRecursiveMode() {
+	handler := suite.newHandler(RecursionModeRecursive, "127.0.0.1")
+
+	suite.Equal(dns.RcodeSuccess, suite.query(handler, "127.0.0.1", "foo.internal.").Rcode)
+	suite.Equal(dns.RcodeRefused, suite.query(handler, "192.0.2.53", "foo.internal.").Rcode)
+	suite.Equal(dns.RcodeRefused, suite.query(handler, "192.0.2.53", "www.example.com.").Rcode)
+}
+
+func (suite *RecursionTestSuite) TestShouldCacheTheResponsesByRecursionAvailable() {
+	config := DnsConfig{Zones: []string{"internal."}, Recursion: RecursionConfig{AllowedIPs: []string{"127.0.0.1"}}}
+	handler := NewQuestionResolverHandler(suite.db, nil, NewResponseCache(0), config, nil)
+
+	suite.True(suite.query(handler, "127.0.0.1", "foo.internal.").RecursionAvailable)
+	suite.False(suite.query(handler, "192.0.2.53", "foo.internal.").RecursionAvailable)
+}
+
+func (suite *RecursionTestSuite) TestShouldOnlyRecurseForThePrivateNetworksByDefault() {
+	handler := suite.newHandler(RecursionModeBoth)
+
+	for _, ip := range []string{"127.0.0.1", "::1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "fd00::1"} {
+		suite.Equal(dns.RcodeSuccess, suite.query(handler, ip, "www.example.com.").Rcode, ip)
+	}
+
+	msg := suite.query(handler, "192.0.2.53", "www.example.com.")
+	suite.Equal(dns.RcodeRefused, msg.Rcode, "the server isn't an open resolver")
+
+	msg = suite.query(handler, "192.0.2.53", "foo.internal.")
+	suite.Equal(dns.RcodeSuccess, msg.Rcode)
+	suite.Len(msg.Answer, 1)
+}
+
+func (suite *RecursionTestSuite) TestShouldRejectAnUnknownMode() {
+	_, err := ParseRecursionMode("open")
+	suite.NotNil(err)
+}
+
+func TestRecursionTestSuite(t *testing.T) {
+	suite.Run(t, new(RecursionTestSuite))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+)
+
+// zoneCut return the delegation point above the qname in our zones: the highest name below the apex
+// which owns a NS RRset, or an empty string when the qname is authoritative data.
+// The DS RRset of a delegation belongs to the parent zone, so a DS query at a zone cut isn't referred. c.f RFC 4035 section 3.1.4.1
+func (h *QuestionResolverHandler) zoneCut(qname string, qtype uint16) string {
+	qname = utils.ToLowerFQDN(qname)
+	zone, found := utils.FindZone(qname, h.config.Zones)
+
+	if !found {
+		return ""
+	}
+
+	// The ancestors are walked from the apex down to the qname
+	names := []string{}
+
+	for name := qname; name != zone; name, _ = utils.Parent(name) {
+		names = append([]string{name}, names...)
+	}
+
+	for _, name := range names {
+		if name == qname && qtype == dns.TypeDS {
+			break
+		}
+
+		if containsType(h.typesAtName(name), dns.TypeNS) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// referral fill the response with the NS RRset of the zone cut in the authority section, and the addresses
+// of the name servers which are in our zones, the glue, in the additional section.
+// The response isn't authoritative, the child zone is. c.f RFC 1034 section 4.3.2
+func (h *QuestionResolverHandler) referral(msg *dns.Msg, cut string, dnssecOK bool) int {
+	msg.Authoritative = false
+	msg.Ns = h.localRRset(cut, dns.TypeNS)
+
+	// The NS RRset of a delegation isn't signed, the DS RRset is. Without DS, the delegation is insecure:
+	// the signed NSEC of the zone cut proves it, its bitmap has NS and no DS. c.f RFC 4035 section 3.1.4.1
+	if dnssecOK && h.signer != nil {
+		rrset := h.localRRset(cut, dns.TypeDS)
+
+		if zoneSigner := h.signer.ZoneSigner(cut); len(rrset) == 0 && zoneSigner != nil {
+			rrset = []dns.RR{zoneSigner.DenialOfExistence(cut, []uint16{dns.TypeNS}, negativeTTL(h.getSOAForTheZone(zoneSigner.Zone())))}
+		}
+
+		msg.Ns = append(msg.Ns, h.signer.Sign(rrset)...)
+	}
+
+	for _, rr := range msg.Ns {
+		ns, ok := rr.(*dns.NS)
+
+		if !ok || !h.isALocalRecord(ns.Ns) {
+			continue
+		}
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			msg.Extra = append(msg.Extra, h.localRRset(ns.Ns, qtype)...)
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// localRRset return the RRset of type qtype owned by the name in the local DB, without following the CNAME
+func (h *QuestionResolverHandler) localRRset(name string, qtype uint16) (rrset []dns.RR) {
+	rrs, _ := h.selectRRsInLocalDb(dns.Fqdn(name), qtype)
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			rrset = append(rrset, rr)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type ReferralTestSuite struct {
+	suite.Suite
+	handler QuestionResolverHandler
+}
+
+func (suite *ReferralTestSuite) SetupTest() {
+	rrsets := [][]dns.RR{
+		{testRR("foo.internal. 3600 IN A 127.0.0.1")},
+		{testRR("sub.internal. 3600 IN NS ns1.sub.internal."), testRR("sub.internal. 3600 IN NS ns.example.com.")},
+		{testRR("sub.internal. 3600 IN DS 60485 5 1 2BB183AF5F22588179A53B0A98631FAD1A292118")},
+		{testRR("ns1.sub.internal. 3600 IN A 192.0.2.1")},
+		{testRR("ns1.sub.internal. 3600 IN AAAA 2001:db8::1")},
+		{testRR("alias.internal. 3600 IN CNAME www.sub.internal.")},
+	}
+
+	suite.handler = newTestHandler(DnsConfig{Zones: []string{"internal."}}, rrsets...)
+}
+
+func (suite *ReferralTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *ReferralTestSuite) query(qname string, qtype uint16) *dns.Msg {
+	w := newTestUDPResponseWriter()
+	suite.handler.ServeDNS(w, new(dns.Msg).SetQuestion(qname, qtype))
+
+	return w.msg
+}
+
+func (suite *ReferralTestSuite) assertReferral(msg *dns.Msg) {
+	suite.Equal(dns.RcodeSuccess, msg.Rcode)
+	suite.False(msg.Authoritative)
+	suite.Empty(msg.Answer)
+	suite.Len(msg.Ns, 2)
+
+	for _, rr := range msg.Ns {
+		suite.Equal(dns.TypeNS, rr.Header().Rrtype)
+	}
+
+	// Only the name server in our zone has glue
+	suite.Len(msg.Extra, 2)
+	suite.Equal("ns1.sub.internal.\t3600\tIN\tA\t192.0.2.1", msg.Extra[0].String())
+	suite.Equal("ns1.sub.internal.\t3600\tIN\tAAAA\t2001:db8::1", msg.Extra[1].String())
+}
+
+func (suite *ReferralTestSuite) TestShouldReferTheNamesBelowAZoneCut() {
+	suite.assertReferral(suite.query("www.sub.internal.", dns.TypeA))
+	suite.assertReferral(suite.query("sub.internal.", dns.TypeNS))
+	suite.assertReferral(suite.query("SUB.internal.", dns.TypeA))
+}
+
+func (suite *ReferralTestSuite) TestShouldNotAnswerWithTheGlue() {
+	suite.assertReferral(suite.query("ns1.sub.internal.", dns.TypeA))
+}
+
+func (suite *ReferralTestSuite) TestShouldAnswerTheDSAtTheZoneCut() {
+	msg := suite.query("sub.internal.", dns.TypeDS)
+
+	suite.True(msg.Authoritative)
+	suite.Len(msg.Answer, 1)
+	suite.Equal(dns.TypeDS, msg.Answer[0].Header().Rrtype)
+}
+
+func (suite *ReferralTestSuite) TestShouldAnswerTheAuthoritativeData() {
+	msg := suite.query("foo.internal.", dns.TypeA)
+
+	suite.True(msg.Authoritative)
+	suite.Len(msg.Answer, 1)
+	suite.Empty(msg.Extra)
+}
+
+func (suite *ReferralTestSuite) TestShouldStopTheCNAMEAtAZoneCut() {
+	msg := suite.query("alias.internal.", dns.TypeA)
+
+	suite.True(msg.Authoritative)
+	suite.Len(msg.Answer, 1)
+	suite.Equal(dns.TypeCNAME, msg.Answer[0].Header().Rrtype)
+}
+
+func (suite *ReferralTestSuite) TestShouldFindTheHighestZoneCut() {
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		return putRRset(tx, []byte("deeper.sub.internal.|NS"), testMarshalRR([]dns.RR{testRR("deeper.sub.internal. 3600 IN NS ns.example.com.")}))
+	})
+
+	suite.Equal("sub.internal.", suite.handler.zoneCut("www.deeper.sub.internal.", dns.TypeA))
+	suite.Equal("sub.internal.", suite.handler.zoneCut("sub.internal.", dns.TypeA))
+	suite.Equal("", suite.handler.zoneCut("sub.internal.", dns.TypeDS))
+	suite.Equal("", suite.handler.zoneCut("internal.", dns.TypeNS))
+	suite.Equal("", suite.handler.zoneCut("foo.example.com.", dns.TypeA))
+}
+
+func (suite *ReferralTestSuite) TestShouldProveTheInsecureDelegationsOfASignedZone() {
+	suite.handler.signer = &DnssecSigner{zones: map[string]*ZoneSigner{}}
+	suite.handler.signer.AddZoneSigner(testZoneSigner("internal."))
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		return putRRset(tx, []byte("insecure.internal.|NS"), testMarshalRR([]dns.RR{testRR("insecure.internal. 3600 IN NS ns.example.com.")}))
+	})
+
+	types := func(msg *dns.Msg) (types []uint16) {
+		for _, rr := range msg.Ns {
+			types = append(types, rr.Header().Rrtype)
+		}
+
+		return
+	}
+
+	r := new(dns.Msg).SetQuestion("www.sub.internal.", dns.TypeA)
+	r.SetEdns0(4096, true)
+	w := newTestUDPResponseWriter()
+	suite.handler.ServeDNS(w, r)
+
+	suite.Equal([]uint16{dns.TypeNS, dns.TypeNS, dns.TypeDS, dns.TypeRRSIG}, types(w.msg), "the DS is signed, not the NS")
+
+	r = new(dns.Msg).SetQuestion("www.insecure.internal.", dns.TypeA)
+	r.SetEdns0(4096, true)
+	w = newTestUDPResponseWriter()
+	suite.handler.ServeDNS(w, r)
+
+	suite.False(w.msg.Authoritative)
+	suite.Equal([]uint16{dns.TypeNS, dns.TypeNSEC, dns.TypeRRSIG}, types(w.msg))
+	nsec := w.msg.Ns[1].(*dns.NSEC)
+	suite.Equal("insecure.internal.", nsec.Hdr.Name)
+	suite.Equal([]uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}, nsec.TypeBitMap, "the NSEC proves there is no DS")
+}
+
+func TestReferralTestSuite(t *testing.T) {
+	suite.Run(t, new(ReferralTestSuite))
+}
@@ -9,6 +9,13 @@ import (
 const defaultDNSPort = ":53"
 const defaultCacheSize = 10000
 
+// RecursiveResolver resolves the queries out of our zones: by iterating from the root with the Resolver,
+// or by forwarding them to upstreams with the Forwarder.
+type RecursiveResolver interface {
+	// Resolve return the answers of the query, or an error when it can't be resolved
+	Resolve(qname string, qtype uint16) ([]dns.RR, error)
+}
+
 // Resolver is baded on the Resolver provide by the library dnsr.
 // The resolver caches responses for queries, and liberally!
 // returns DNS records for a given name, not waiting for slow or broken name servers.
@@ -26,7 +33,7 @@ func NewResolver() *Resolver {
 // Resolve find DNS records of type qtype for the domain qname.
 // For nonexistent domains (NXDOMAIN), it will return an empty, non-nil slice.
 // The Resolve method is based on dnsr.Resolver, which queries DNS for given name and type (A, NS, CNAME, etc.).
-func (r *Resolver) Resolve(qname string, qtype uint16) []dns.RR {
+func (r *Resolver) Resolve(qname string, qtype uint16) ([]dns.RR, error) {
 	log.WithFields(log.Fields{
 		"qname": qname,
 		"qtype": dns.TypeToString[qtype],
@@ -47,7 +54,7 @@ func (r *Resolver) Resolve(qname string, qtype uint16) []dns.RR {
 		"answers": rrs,
 	}).Info("get the answer for the resolve query")
 
-	return rrs
+	return rrs, nil
 }
 
 // mapRRFromDnsrIntoRR map the RR from dnsr into the RR of the miekg/dns library.
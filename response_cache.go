@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	a "stream-dns/agent"
+	ms "stream-dns/metrics"
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+)
+
+// Response cache configuration.
+const (
+	DefaultResponseCacheSize = 10000
+	// The cached responses are invalidated when the consumer changes the names they depend on,
+	// the maximum age only bounds the lifetime of the RRSIGs of the signed responses
+	// and of the flattened ALIAS, whose target can be out of our zones.
+	ResponseCacheMaxAge = 60 * time.Second
+)
+
+// ResponseCache keeps the packed authoritative responses, so a query already answered is served
+// without building and packing a dns.Msg again: only the ID of the cached message is changed.
+// Each response is indexed by the names it depends on (the qname, the wildcards which could synthesize it,
+// the targets of the CNAMEs and the apex of the SOA), and it's invalidated as soon as the consumer writes one of them.
+type ResponseCache struct {
+	hits       uint64 // atomic, the queries don't share a lock to be counted, c.f ReportMetrics
+	misses     uint64 // atomic
+	size       int
+	mutex      sync.RWMutex
+	generation uint64 // number of invalidations
+	responses  map[string]*cachedResponse
+	byName     map[string]map[string]struct{} // name -> keys of the responses which depend on it
+}
+
+type cachedResponse struct {
+	raw     []byte
+	names   []string
+	expires time.Time
+}
+
+// NewResponseCache create a cache of size responses at most, it returns nil when the size is negative
+func NewResponseCache(size int) *ResponseCache {
+	if size < 0 {
+		return nil
+	}
+
+	if size == 0 {
+		size = DefaultResponseCacheSize
+	}
+
+	return &ResponseCache{
+		size:      size,
+		responses: make(map[string]*cachedResponse),
+		byName:    make(map[string]map[string]struct{}),
+	}
+}
+
+// responseCacheKey identify the response of a query: the question, the flags copied in the response,
+// the recursion available to the client, the DNSSEC OK bit and the size class, which is the space allowed for the response.
+// The qname is lowered, so the queries which randomize its case share the response, c.f Get.
+func responseCacheKey(r *dns.Msg, recursion bool, edns bool, dnssecOK bool, maxSize int) string {
+	question := r.Question[0]
+	var key strings.Builder
+
+	key.WriteString(utils.ToLowerFQDN(question.Name))
+	key.WriteByte('|')
+	key.WriteString(strconv.Itoa(int(question.Qtype)))
+	key.WriteByte('|')
+	key.WriteString(strconv.Itoa(int(question.Qclass)))
+	key.WriteByte('|')
+
+	for _, flag := range []bool{r.RecursionDesired, r.CheckingDisabled, recursion, edns, dnssecOK} {
+		if flag {
+			key.WriteByte('1')
+		} else {
+			key.WriteByte('0')
+		}
+	}
+
+	key.WriteByte('|')
+	key.WriteString(strconv.Itoa(maxSize))
+
+	return key.String()
+}
+
+// Get return a copy of the packed response with the ID and the case of the question of the query,
+// or nil when it isn't in the cache
+func (c *ResponseCache) Get(key string, query *dns.Msg) []byte {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.RLock()
+	response, found := c.responses[key]
+	c.mutex.RUnlock()
+
+	if !found || time.Now().After(response.expires) {
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+
+	raw := make([]byte, len(response.raw))
+	copy(raw, response.raw)
+	raw[0], raw[1] = byte(query.Id>>8), byte(query.Id)
+
+	// The question starts right after the header of 12 bytes, its name is never compressed
+	if len(query.Question) > 0 {
+		qname := make([]byte, 256)
+
+		if n, err := dns.PackDomainName(dns.Fqdn(query.Question[0].Name), qname, 0, nil, false); err == nil &&
+			len(raw) >= 12+n && bytes.EqualFold(raw[12:12+n], qname[:n]) {
+			copy(raw[12:], qname[:n])
+		}
+	}
+
+	return raw
+}
+
+// Generation return the number of invalidations, it's read before building a response: if the cache
+// was invalidated in the meantime, the response may have been built from the RRs just replaced.
+func (c *ResponseCache) Generation() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.generation
+}
+
+// Set keep the packed response of the msg, which was built from the RRs owned by the names,
+// during maxAge at most: a response can't be served longer than the TTL of its answers.
+// The response isn't kept when the cache was invalidated since the generation read before building it.
+func (c *ResponseCache) Set(key string, raw []byte, names []string, maxAge time.Duration, generation uint64) {
+	if c == nil || maxAge <= 0 {
+		return
+	}
+
+	if maxAge > ResponseCacheMaxAge {
+		maxAge = ResponseCacheMaxAge
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+
+	if _, found := c.responses[key]; !found && len(c.responses) >= c.size {
+		// Evict any response, the hot ones come back at the next query
+		for evicted := range c.responses {
+			c.remove(evicted)
+			break
+		}
+	}
+
+	c.remove(key)
+	c.responses[key] = &cachedResponse{raw: raw, names: names, expires: time.Now().Add(maxAge)}
+
+	for _, name := range names {
+		if c.byName[name] == nil {
+			c.byName[name] = make(map[string]struct{})
+		}
+
+		c.byName[name][key] = struct{}{}
+	}
+}
+
+// Invalidate remove the responses which depend on the names or on their ancestors, it's called when the
+// consumer changes them. A new name can turn its ancestors into empty non-terminals, which stop the wildcards.
+func (c *ResponseCache) Invalidate(names ...string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+
+	for _, name := range names {
+		name = utils.ToLowerFQDN(name)
+
+		for ok := true; ok; name, ok = utils.Parent(name) {
+			for key := range c.byName[name] {
+				c.remove(key)
+			}
+		}
+	}
+}
+
+// ReportMetrics send to the metrics service, every interval, the hits and misses counted since the previous report
+func (c *ResponseCache) ReportMetrics(metricsService *a.MetricsService, interval time.Duration) {
+	if c == nil || metricsService == nil {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			c.reportMetrics(metricsService)
+		}
+	}()
+}
+
+func (c *ResponseCache) reportMetrics(metricsService *a.MetricsService) {
+	for metricName, counter := range map[string]*uint64{"response-cache-hit": &c.hits, "response-cache-miss": &c.misses} {
+		if count := atomic.SwapUint64(counter, 0); count > 0 {
+			metricsService.GetOrCreateAggregator(metricName, ms.Counter, false).(a.AggregatorCounter).Inc(int(count))
+		}
+	}
+}
+
+func (c *ResponseCache) remove(key string) {
+	response, found := c.responses[key]
+
+	if !found {
+		return
+	}
+
+	delete(c.responses, key)
+
+	for _, name := range response.names {
+		delete(c.byName[name], key)
+
+		if len(c.byName[name]) == 0 {
+			delete(c.byName, name)
+		}
+	}
+}
+
+// responseMaxAge return how long the response can be cached: the smallest TTL of its answers
+func responseMaxAge(msg *dns.Msg) time.Duration {
+	if len(msg.Answer) == 0 {
+		return ResponseCacheMaxAge
+	}
+
+	return time.Duration(minTTL(msg.Answer)) * time.Second
+}
+
+// responseDependencies return the names of the RRs used to build the response of the qname:
+// the qname, the targets of the CNAMEs, the owner of the SOA of a negative answer and the targets
+// of the additional section. The ancestors of
+// these names and the wildcards under them are dependencies too, they decide of the wildcard synthesis.
+func (h *QuestionResolverHandler) responseDependencies(qname string, msg *dns.Msg) []string {
+	names := map[string]struct{}{}
+	addName := func(name string) {
+		name = utils.ToLowerFQDN(name)
+		zone, _ := utils.FindZone(name, h.config.Zones)
+		names[name] = struct{}{}
+
+		// The apex always exists, only its SOA is a dependency
+		for ancestor, ok := utils.Parent(name); ok && dns.IsSubDomain(zone, ancestor); ancestor, ok = utils.Parent(ancestor) {
+			if ancestor != zone {
+				names[ancestor] = struct{}{}
+			}
+
+			names["*."+strings.TrimPrefix(ancestor, ".")] = struct{}{}
+		}
+	}
+
+	addName(qname)
+
+	for _, rr := range msg.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			addName(cname.Target)
+		}
+	}
+
+	for _, rr := range msg.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			addName(rr.Header().Name)
+		}
+	}
+
+	// The additional section and the glue of a referral
+	for _, target := range append(additionalTargets(msg.Answer), additionalTargets(msg.Ns)...) {
+		addName(target)
+	}
+
+	dependencies := make([]string, 0, len(names))
+
+	for name := range names {
+		dependencies = append(dependencies, name)
+	}
+
+	return dependencies
+}
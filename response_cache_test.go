@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type ResponseCacheTestSuite struct {
+	suite.Suite
+	handler  QuestionResolverHandler
+	consumer *KafkaConsumer
+	cache    *ResponseCache
+}
+
+func (suite *ResponseCacheTestSuite) SetupTest() {
+	db := newTestDB()
+
+	config := DnsConfig{Zones: []string{"internal."}}
+	suite.cache = NewResponseCache(0)
+	suite.handler = NewQuestionResolverHandler(db, nil, suite.cache, config, nil)
+	suite.consumer = &KafkaConsumer{db: db, zones: config.Zones, responseCache: suite.cache}
+
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.1"))
+	suite.register("www.internal.|CNAME", testRR("www.internal. 2700 IN CNAME foo.internal."))
+}
+
+func (suite *ResponseCacheTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *ResponseCacheTestSuite) register(key string, rrs ...dns.RR) {
+	suite.Nil(suite.consumer.registerRecordAsBytesWithTheKeyInDB([]byte(key), rrs, false))
+}
+
+// deleteWithoutInvalidation remove a key behind the back of the cache, so only a cached response still has it
+func (suite *ResponseCacheTestSuite) deleteWithoutInvalidation(key string) {
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		return deleteRRset(tx, []byte(key))
+	})
+}
+
+func (suite *ResponseCacheTestSuite) query(m *dns.Msg) *dns.Msg {
+	w := newTestUDPResponseWriter()
+	suite.handler.ServeDNS(w, m)
+
+	return w.msg
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldServeTheCachedResponseWithTheIDOfTheQuery() {
+	suite.Len(suite.query(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)).Answer, 1)
+	suite.deleteWithoutInvalidation("foo.internal.|A")
+
+	m := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+	msg := suite.query(m)
+
+	suite.Equal(m.Id, msg.Id)
+	suite.True(msg.Authoritative)
+	suite.Len(msg.Answer, 1)
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldCacheTheResponsesByDnssecOKAndSizeClass() {
+	suite.query(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+	suite.deleteWithoutInvalidation("foo.internal.|A")
+
+	m := new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	suite.Empty(suite.query(m).Answer)
+
+	m = new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	suite.Empty(suite.query(m).Answer)
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldInvalidateTheResponsesOfTheNameWrittenByTheConsumer() {
+	suite.query(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.2"))
+
+	msg := suite.query(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+	suite.Equal("127.0.0.2", msg.Answer[0].(*dns.A).A.String())
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldInvalidateTheResponsesWhichFollowedACNAME() {
+	suite.Len(suite.query(new(dns.Msg).SetQuestion("www.internal.", dns.TypeA)).Answer, 2)
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.2"))
+
+	msg := suite.query(new(dns.Msg).SetQuestion("www.internal.", dns.TypeA))
+	suite.Len(msg.Answer, 2)
+	suite.Equal("127.0.0.2", msg.Answer[1].(*dns.A).A.String())
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldInvalidateTheNegativeResponsesWithTheSOAOfTheZone() {
+	suite.Equal(dns.RcodeNameError, suite.query(new(dns.Msg).SetQuestion("bar.internal.", dns.TypeA)).Rcode)
+	suite.register("baz.internal.|A", testRR("baz.internal. 2700 IN A 127.0.0.3"))
+
+	msg := suite.query(new(dns.Msg).SetQuestion("bar.internal.", dns.TypeA))
+	suite.Equal(uint32(4), msg.Ns[0].(*dns.SOA).Serial, "the serial of the SOA changes with every record of the zone")
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldEvictAResponseWhenTheCacheIsFull() {
+	cache := NewResponseCache(1)
+	query := &dns.Msg{MsgHdr: dns.MsgHdr{Id: 42}}
+	cache.Set("foo", []byte{0, 0, 1}, []string{"foo.internal."}, ResponseCacheMaxAge, 0)
+	cache.Set("bar", []byte{0, 0, 2}, []string{"bar.internal."}, ResponseCacheMaxAge, 0)
+	// A response with a TTL of 0 isn't cached
+	cache.Set("baz", []byte{0, 0, 3}, []string{"baz.internal."}, 0, 0)
+
+	suite.Nil(cache.Get("foo", query))
+	suite.Equal([]byte{0, 42, 2}, cache.Get("bar", query))
+	suite.Len(cache.byName, 1)
+
+	cache.Invalidate("BAR.internal")
+	suite.Nil(cache.Get("bar", query))
+	suite.Empty(cache.byName)
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldNotKeepAResponseBuiltBeforeAnInvalidation() {
+	generation := suite.cache.Generation()
+	suite.cache.Invalidate("bar.internal.")
+
+	suite.cache.Set("foo", []byte{0, 0, 1}, []string{"foo.internal."}, ResponseCacheMaxAge, generation)
+	suite.Nil(suite.cache.Get("foo", new(dns.Msg)), "the response may have been built from the RRs just replaced")
+
+	suite.cache.Set("foo", []byte{0, 0, 1}, []string{"foo.internal."}, ResponseCacheMaxAge, suite.cache.Generation())
+	suite.NotNil(suite.cache.Get("foo", new(dns.Msg)))
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldShareTheResponseWhateverTheCaseOfTheQuestion() {
+	suite.query(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+	suite.deleteWithoutInvalidation("foo.internal.|A")
+
+	msg := suite.query(new(dns.Msg).SetQuestion("FoO.InTeRnAl.", dns.TypeA))
+
+	suite.Len(msg.Answer, 1)
+	suite.Equal("FoO.InTeRnAl.", msg.Question[0].Name, "the case of the question is kept")
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldCountTheHitsAndMisses() {
+	suite.query(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+	suite.query(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+	suite.query(new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+
+	suite.Equal(uint64(2), suite.cache.hits)
+	suite.Equal(uint64(1), suite.cache.misses)
+}
+
+func (suite *ResponseCacheTestSuite) TestShouldBeDisabledWithANegativeSize() {
+	suite.Nil(NewResponseCache(-1))
+}
+
+func TestResponseCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(ResponseCacheTestSuite))
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Response rate limiting configuration.
+const (
+	DefaultRrlSlip             = 2  // one limited response in two is truncated, the other is dropped
+	DefaultRrlIPv4PrefixLength = 24 // the clients of the same /24 share their rate
+	DefaultRrlIPv6PrefixLength = 56
+	// Interval between two cleanups of the buckets of the clients which are under their rate again
+	RrlPruneInterval = 10 * time.Second
+	// Maximum number of buckets, so the spoofed queries of many networks can't grow the table without limit
+	RrlMaxBuckets = 100000
+)
+
+// Classes of the responses, each one has its own rate
+const (
+	RrlClassAnswer   = "answer"   // positive and NODATA answers, referrals
+	RrlClassNxdomain = "nxdomain" // the random subdomains of a zone share the same rate
+	RrlClassError    = "error"    // all the other rcodes
+)
+
+// Actions of the rate limiter, they are used as metric names
+const (
+	RrlPass   = "rrl-passed"
+	RrlDrop   = "rrl-dropped"
+	RrlSlip   = "rrl-slipped"
+	RrlExempt = "rrl-exempt" // the client is in an exempt network
+)
+
+// RateLimiter limits the rate of the identical responses sent to a network over UDP, so the server isn't
+// a reflection amplifier for spoofed queries. The real clients retry over TCP after a truncated response,
+// which can't be spoofed. c.f https://kb.isc.org/docs/aa-00994
+type RateLimiter struct {
+	rates      map[string]float64 // responses per second by class
+	slip       int
+	ipv4Mask   net.IPMask
+	ipv6Mask   net.IPMask
+	exempt     []*net.IPNet
+	mutex      sync.Mutex
+	buckets    map[string]*rrlBucket // <prefix>|<class>|<name> -> bucket
+	maxBuckets int
+	lastPrune  time.Time
+	now        func() time.Time
+}
+
+// rrlBucket is a token bucket which gets `rate` tokens per second, up to `rate` tokens
+type rrlBucket struct {
+	*utils.TokenBucket
+	limited int // responses limited since the bucket is empty, to slip one in `slip`
+}
+
+// NewRateLimiter create the rate limiter of the configuration, nil when the rate limiting is disabled
+func NewRateLimiter(config RrlConfig) (*RateLimiter, error) {
+	if config.ResponsesPerSecond <= 0 {
+		return nil, nil
+	}
+
+	exempt, err := utils.ParseCIDRs(config.ExemptIPs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Slip < 0 {
+		return nil, fmt.Errorf("invalid slip %d, must be positive or 0 to drop all the limited responses", config.Slip)
+	}
+
+	if config.IPv4PrefixLength < 0 || config.IPv4PrefixLength > 32 || config.IPv6PrefixLength < 0 || config.IPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("invalid prefix length /%d or /%d", config.IPv4PrefixLength, config.IPv6PrefixLength)
+	}
+
+	rl := &RateLimiter{
+		rates: map[string]float64{
+			RrlClassAnswer:   float64(config.ResponsesPerSecond),
+			RrlClassNxdomain: float64(config.NxdomainsPerSecond),
+			RrlClassError:    float64(config.ErrorsPerSecond),
+		},
+		slip:       config.Slip,
+		ipv4Mask:   net.CIDRMask(config.IPv4PrefixLength, 32),
+		ipv6Mask:   net.CIDRMask(config.IPv6PrefixLength, 128),
+		exempt:     exempt,
+		buckets:    make(map[string]*rrlBucket),
+		maxBuckets: RrlMaxBuckets,
+		now:        time.Now,
+	}
+
+	// The NXDOMAIN and the errors are limited like the answers by default
+	for class, rate := range rl.rates {
+		if rate <= 0 {
+			rl.rates[class] = float64(config.ResponsesPerSecond)
+		}
+	}
+
+	if config.IPv4PrefixLength == 0 {
+		rl.ipv4Mask = net.CIDRMask(DefaultRrlIPv4PrefixLength, 32)
+	}
+
+	if config.IPv6PrefixLength == 0 {
+		rl.ipv6Mask = net.CIDRMask(DefaultRrlIPv6PrefixLength, 128)
+	}
+
+	return rl, nil
+}
+
+// Action decide if a response of the class about the name can be sent to the client: RrlPass, RrlDrop, RrlSlip or RrlExempt
+func (rl *RateLimiter) Action(ip net.IP, class string, name string) string {
+	if ip == nil || utils.ContainsIP(rl.exempt, ip) {
+		return RrlExempt
+	}
+
+	key := rl.prefix(ip) + "|" + class + "|" + name
+	rate := rl.rates[class]
+	now := rl.now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.prune(now)
+	bucket, found := rl.buckets[key]
+
+	if !found {
+		rl.makeRoom(now)
+		bucket = &rrlBucket{TokenBucket: utils.NewTokenBucket(now, rate)}
+		rl.buckets[key] = bucket
+	}
+
+	if bucket.Take(now, rate, rate) {
+		bucket.limited = 0
+		return RrlPass
+	}
+
+	bucket.limited++
+
+	if rl.slip > 0 && bucket.limited%rl.slip == 0 {
+		return RrlSlip
+	}
+
+	return RrlDrop
+}
+
+// prune remove the full buckets, at most once by RrlPruneInterval
+func (rl *RateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < RrlPruneInterval {
+		return
+	}
+
+	rl.removeFullBuckets(now)
+	rl.lastPrune = now
+}
+
+// removeFullBuckets remove the buckets which are full again, they are the same as new ones
+func (rl *RateLimiter) removeFullBuckets(now time.Time) {
+	for key, bucket := range rl.buckets {
+		rate := rl.rates[strings.SplitN(key, "|", 3)[1]]
+
+		if bucket.Full(now, rate, rate) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// makeRoom free a bucket when the table is full: the full buckets are removed first,
+// then an arbitrary one, which only resets the rate of its network
+func (rl *RateLimiter) makeRoom(now time.Time) {
+	if len(rl.buckets) < rl.maxBuckets {
+		return
+	}
+
+	rl.removeFullBuckets(now)
+
+	for key := range rl.buckets {
+		if len(rl.buckets) < rl.maxBuckets {
+			return
+		}
+
+		delete(rl.buckets, key)
+	}
+}
+
+// prefix return the network of the client, e.g: 192.0.2.0 for 192.0.2.1 with a /24
+func (rl *RateLimiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(rl.ipv4Mask).String()
+	}
+
+	return ip.Mask(rl.ipv6Mask).String()
+}
+
+// rrlClass return the class of a response and the name it's limited by: the qname and qtype of an answer,
+// or the wildcard of a synthesized answer, and the zone of a NXDOMAIN, so a random subdomain attack is
+// limited as a whole, and nothing for an error
+func (h *QuestionResolverHandler) rrlClass(question dns.Question, rcode int) (class string, name string) {
+	switch rcode {
+	case dns.RcodeSuccess:
+		if source, found := h.wildcardSource(question.Name); found {
+			return RrlClassAnswer, source + "/" + dns.TypeToString[question.Qtype]
+		}
+
+		return RrlClassAnswer, strings.ToLower(question.Name) + "/" + dns.TypeToString[question.Qtype]
+	case dns.RcodeNameError:
+		if zone := h.zoneOf(question.Name); zone != "" {
+			return RrlClassNxdomain, zone
+		}
+
+		return RrlClassNxdomain, strings.ToLower(question.Name)
+	default:
+		return RrlClassError, ""
+	}
+}
+
+// rateLimited apply the response rate limiting to a response over UDP. It returns true when the response
+// must not be sent: it's dropped, or a truncated response is sent instead so a real client retries over TCP.
+func (h *QuestionResolverHandler) rateLimited(w dns.ResponseWriter, r *dns.Msg, rcode int) bool {
+	if h.rateLimiter == nil || isTCP(w) {
+		return false
+	}
+
+	class, name := h.rrlClass(r.Question[0], rcode)
+	action := h.rateLimiter.Action(utils.IPFromAddr(w.RemoteAddr()), class, name)
+	h.incMetric(action)
+
+	switch action {
+	case RrlSlip:
+		msg := dns.Msg{}
+		msg.SetReply(r)
+		msg.Truncated = true
+		w.WriteMsg(&msg)
+	case RrlDrop:
+		log.WithFields(log.Fields{"ip": w.RemoteAddr().String(), "class": class, "name": name}).Debug("Dropped a rate limited response")
+	}
+
+	return action == RrlDrop || action == RrlSlip
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type RrlTestSuite struct {
+	suite.Suite
+	handler QuestionResolverHandler
+	now     time.Time
+}
+
+func (suite *RrlTestSuite) SetupTest() {
+	db := newTestDB([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")})
+
+	config := DnsConfig{
+		Zones: []string{"internal."},
+		Rrl:   RrlConfig{ResponsesPerSecond: 2, Slip: 2, ExemptIPs: []string{"10.0.0.0/8"}},
+	}
+	suite.handler = NewQuestionResolverHandler(db, nil, NewResponseCache(0), config, nil)
+	suite.now = time.Now()
+	suite.handler.rateLimiter.now = func() time.Time { return suite.now }
+}
+
+func (suite *RrlTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+// query ask the qname over UDP from the address, it returns nil when the response is dropped
+func (suite *RrlTestSuite) query(ip string, qname string) *dns.Msg {
+	w := newTestUDPResponseWriter()
+	w.remoteAddr = &net.UDPAddr{IP: net.ParseIP(ip), Port: 4242}
+	suite.handler.ServeDNS(w, new(dns.Msg).SetQuestion(qname, dns.TypeA))
+
+	return w.msg
+}
+
+func (suite *RrlTestSuite) TestShouldDropOrSlipTheResponsesOverTheRate() {
+	for i := 0; i < 2; i++ {
+		msg := suite.query("192.0.2.1", "foo.internal.")
+
+		if suite.NotNil(msg) {
+			suite.Len(msg.Answer, 1)
+			suite.False(msg.Truncated)
+		}
+	}
+
+	suite.Nil(suite.query("192.0.2.2", "foo.internal."), "the clients of the same /24 share their rate")
+
+	msg := suite.query("192.0.2.3", "foo.internal.")
+
+	if suite.NotNil(msg, "one limited response in two is truncated") {
+		suite.True(msg.Truncated)
+		suite.Empty(msg.Answer)
+	}
+
+	suite.NotNil(suite.query("198.51.100.1", "foo.internal."), "another network has its own rate")
+	suite.NotNil(suite.query("10.0.0.1", "foo.internal."), "an exempt client isn't limited")
+
+	suite.now = suite.now.Add(time.Second)
+	suite.NotNil(suite.query("192.0.2.1", "foo.internal."), "the rate is refilled every second")
+}
+
+func (suite *RrlTestSuite) TestShouldLimitTheNxdomainOfAZoneTogether() {
+	suite.NotNil(suite.query("192.0.2.1", "a.internal."))
+	suite.NotNil(suite.query("192.0.2.1", "b.internal."))
+	suite.Nil(suite.query("192.0.2.1", "c.internal."))
+
+	msg := suite.query("192.0.2.1", "foo.internal.")
+
+	if suite.NotNil(msg, "the answers have their own rate") {
+		suite.Len(msg.Answer, 1)
+	}
+}
+
+func (suite *RrlTestSuite) TestShouldLimitTheAnswersOfAWildcardTogether() {
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		return putRRset(tx, []byte("*.wild.internal.|A"), testMarshalRR([]dns.RR{testRR("*.wild.internal. 2700 IN A 127.0.0.2")}))
+	})
+
+	suite.NotNil(suite.query("192.0.2.1", "a.wild.internal."))
+	suite.NotNil(suite.query("192.0.2.1", "b.wild.internal."))
+	suite.Nil(suite.query("192.0.2.1", "c.wild.internal."), "the random labels share the rate of the wildcard")
+
+	msg := suite.query("192.0.2.1", "foo.internal.")
+
+	if suite.NotNil(msg, "the other answers have their own rate") {
+		suite.Len(msg.Answer, 1)
+	}
+}
+
+func (suite *RrlTestSuite) TestShouldNeverLimitTCP() {
+	for i := 0; i < 5; i++ {
+		w := newTestTCPResponseWriter()
+		suite.handler.ServeDNS(w, new(dns.Msg).SetQuestion("foo.internal.", dns.TypeA))
+		suite.NotNil(w.msg)
+	}
+}
+
+func (suite *RrlTestSuite) TestShouldPruneTheFullBuckets() {
+	suite.query("192.0.2.1", "foo.internal.")
+	suite.query("198.51.100.1", "foo.internal.")
+	suite.query("198.51.100.1", "foo.internal.")
+	suite.Len(suite.handler.rateLimiter.buckets, 2)
+
+	suite.now = suite.now.Add(RrlPruneInterval)
+	suite.query("203.0.113.1", "foo.internal.")
+	suite.Len(suite.handler.rateLimiter.buckets, 1)
+}
+
+func (suite *RrlTestSuite) TestShouldKeepTheBucketsUnderTheMaximum() {
+	suite.handler.rateLimiter.maxBuckets = 2
+
+	for _, ip := range []string{"192.0.2.1", "198.51.100.1", "203.0.113.1", "203.0.114.1"} {
+		suite.query(ip, "foo.internal.")
+		suite.query(ip, "foo.internal.")
+		suite.True(len(suite.handler.rateLimiter.buckets) <= 2)
+	}
+
+	_, found := suite.handler.rateLimiter.buckets["203.0.114.0|answer|foo.internal./A"]
+	suite.True(found, "the bucket of the last network is kept")
+}
+
+func (suite *RrlTestSuite) TestShouldBeDisabledWithoutRate() {
+	rl, err := NewRateLimiter(RrlConfig{})
+	suite.Nil(err)
+	suite.Nil(rl)
+
+	_, err = NewRateLimiter(RrlConfig{ResponsesPerSecond: 5, Slip: -1})
+	suite.NotNil(err)
+
+	_, err = NewRateLimiter(RrlConfig{ResponsesPerSecond: 5, IPv4PrefixLength: 33})
+	suite.NotNil(err)
+}
+
+func TestRrlTestSuite(t *testing.T) {
+	suite.Run(t, new(RrlTestSuite))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Policies to compute the next serial of a zone
+const (
+	SerialPolicyIncrement = "increment" // serial + 1
+	SerialPolicyDate      = "date"      // YYYYMMDDnn. c.f RFC 1912 section 2.2
+	SerialPolicyUnixTime  = "unixtime"  // seconds since epoch
+)
+
+// Values of the SOA synthesized for a zone without SOA. c.f RFC 1912 section 2.2
+const (
+	DefaultSOATTL     = 3600
+	DefaultSOARefresh = 7200
+	DefaultSOARetry   = 3600
+	DefaultSOAExpire  = 1209600
+	DefaultSOAMinttl  = 300
+	// First serial of a zone which has never changed, whatever the policy
+	DefaultSOASerial = 1
+)
+
+// ParseSerialPolicy check the policy of the configuration, the serial is incremented by default
+func ParseSerialPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return SerialPolicyIncrement, nil
+	case SerialPolicyIncrement, SerialPolicyDate, SerialPolicyUnixTime:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown SOA serial policy %s, must be one of %s, %s or %s", policy, SerialPolicyIncrement, SerialPolicyDate, SerialPolicyUnixTime)
+	}
+}
+
+// defaultSOA synthesize the SOA of a zone for which no SOA was ever produced
+func defaultSOA(zone string, config SoaConfig) *dns.SOA {
+	zone = utils.ZoneApex(zone)
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: DefaultSOATTL},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  DefaultSOASerial,
+		Refresh: DefaultSOARefresh,
+		Retry:   DefaultSOARetry,
+		Expire:  DefaultSOAExpire,
+		Minttl:  DefaultSOAMinttl,
+	}
+
+	if config.Ns != "" {
+		soa.Ns = utils.ToLowerFQDN(config.Ns)
+	}
+
+	if config.Mbox != "" {
+		soa.Mbox = utils.ToLowerFQDN(config.Mbox)
+	}
+
+	return soa
+}
+
+// nextSerial return the serial of the next version of a zone according to the policy.
+// The serial always grows in the serial number arithmetic, even when the clock goes backward. c.f RFC 1982
+func nextSerial(serial uint32, policy string, now time.Time) uint32 {
+	next := serial + 1
+	var candidate uint32
+
+	switch policy {
+	case SerialPolicyDate:
+		date, _ := strconv.ParseUint(now.UTC().Format("20060102"), 10, 32)
+		candidate = uint32(date) * 100
+	case SerialPolicyUnixTime:
+		candidate = uint32(now.Unix())
+	default:
+		return next
+	}
+
+	if serialGreater(candidate, next) {
+		return candidate
+	}
+
+	return next
+}
+
+// serialGreater compare two serials with the serial number arithmetic. c.f RFC 1982 section 3.2
+func serialGreater(s1, s2 uint32) bool {
+	return s1 != s2 && int32(s1-s2) > 0
+}
+
+// readSOA return the SOA registered for the zone, or nil if no SOA was ever produced or synthesized
+func readSOA(tx *bolt.Tx, zone string) *dns.SOA {
+	return firstSOA(rrsInBucket(tx.Bucket(RecordBucket), utils.Key(zone, dns.TypeSOA)))
+}
+
+func writeSOA(tx *bolt.Tx, soa *dns.SOA) error {
+	raw, err := encodeRRs([]dns.RR{soa})
+
+	if err != nil {
+		return err
+	}
+
+	return putRRset(tx, utils.Key(soa.Hdr.Name, dns.TypeSOA), raw)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestShouldComputeTheNextSerialWithThePolicy(t *testing.T) {
+	now := time.Date(2020, 1, 13, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, uint32(42), nextSerial(41, SerialPolicyIncrement, now))
+	assert.Equal(t, uint32(0), nextSerial(4294967295, SerialPolicyIncrement, now))
+
+	assert.Equal(t, uint32(2020011300), nextSerial(1, SerialPolicyDate, now))
+	assert.Equal(t, uint32(2020011301), nextSerial(2020011300, SerialPolicyDate, now))
+	assert.Equal(t, uint32(2020011401), nextSerial(2020011400, SerialPolicyDate, now), "the serial never goes backward")
+
+	assert.Equal(t, uint32(now.Unix()), nextSerial(1, SerialPolicyUnixTime, now))
+	assert.Equal(t, uint32(now.Unix()+1), nextSerial(uint32(now.Unix()), SerialPolicyUnixTime, now))
+}
+
+func TestShouldCompareTheSerialsWithTheSerialArithmetic(t *testing.T) {
+	assert.True(t, serialGreater(2, 1))
+	assert.False(t, serialGreater(1, 1))
+	assert.False(t, serialGreater(1, 2))
+	assert.True(t, serialGreater(1, 4294967295))
+}
+
+func TestShouldRejectAnUnknownSerialPolicy(t *testing.T) {
+	policy, err := ParseSerialPolicy("")
+	assert.Nil(t, err)
+	assert.Equal(t, SerialPolicyIncrement, policy)
+
+	_, err = ParseSerialPolicy("kafka")
+	assert.NotNil(t, err)
+}
+
+type SerialTestSuite struct {
+	suite.Suite
+	handler  QuestionResolverHandler
+	consumer *KafkaConsumer
+}
+
+func (suite *SerialTestSuite) SetupTest() {
+	db := newTestDB()
+
+	config := DnsConfig{Zones: []string{"internal."}, Soa: SoaConfig{Mbox: "admin.internal"}}
+	suite.handler = NewQuestionResolverHandler(db, nil, nil, config, nil)
+	suite.consumer = &KafkaConsumer{db: db, zones: config.Zones, soa: config.Soa}
+}
+
+func (suite *SerialTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *SerialTestSuite) register(key string, rrs ...dns.RR) {
+	suite.Nil(suite.consumer.registerRecordAsBytesWithTheKeyInDB([]byte(key), rrs, false))
+}
+
+func (suite *SerialTestSuite) serial() uint32 {
+	return suite.handler.getSOAForTheZone("internal.").(*dns.SOA).Serial
+}
+
+func (suite *SerialTestSuite) TestShouldSynthesizeTheSOAOfAZoneWithoutSOA() {
+	soa := suite.handler.getSOAForTheZone("internal.")
+
+	suite.Equal("internal.\t3600\tIN\tSOA\tns.internal. admin.internal. 1 7200 3600 1209600 300", soa.String())
+	suite.Nil(suite.handler.getSOAForTheZone("foo.internal."))
+}
+
+func (suite *SerialTestSuite) TestShouldAnswerTheSynthesizedSOAOfTheApex() {
+	w := newTestUDPResponseWriter()
+	suite.handler.ServeDNS(w, new(dns.Msg).SetQuestion("internal.", dns.TypeSOA))
+
+	suite.Equal(dns.RcodeSuccess, w.msg.Rcode)
+
+	if suite.Len(w.msg.Answer, 1) {
+		suite.Equal(dns.TypeSOA, w.msg.Answer[0].Header().Rrtype)
+		suite.Equal("internal.", w.msg.Answer[0].Header().Name)
+	}
+
+	suite.Empty(w.msg.Ns)
+}
+
+func (suite *SerialTestSuite) TestShouldBumpTheSerialOnEachChangeInTheZone() {
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.1"))
+	suite.Equal(uint32(2), suite.serial())
+
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.2"))
+	suite.Equal(uint32(3), suite.serial())
+
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.2"))
+	suite.Equal(uint32(3), suite.serial(), "a record registered again without change isn't a new version")
+
+	suite.register("foo.example.com.|A", testRR("foo.example.com. 2700 IN A 127.0.0.1"))
+	suite.Equal(uint32(3), suite.serial())
+}
+
+func (suite *SerialTestSuite) TestShouldNeverLetAProducedSOAMoveTheSerialBackward() {
+	suite.register("internal.|SOA", testRR("internal. 3600 IN SOA ns.internal. admin.internal. 10 7200 3600 1209600 300"))
+	suite.Equal(uint32(10), suite.serial())
+
+	suite.register("internal.|SOA", testRR("internal. 3600 IN SOA ns.internal. admin.internal. 5 7200 3600 1209600 600"))
+	suite.Equal(uint32(11), suite.serial())
+	suite.Equal(uint32(600), suite.handler.getSOAForTheZone("internal.").(*dns.SOA).Minttl)
+
+	suite.register("internal.|SOA", testRR("internal. 3600 IN SOA ns.internal. admin.internal. 20 7200 3600 1209600 600"))
+	suite.Equal(uint32(20), suite.serial())
+}
+
+func TestSerialTestSuite(t *testing.T) {
+	suite.Run(t, new(SerialTestSuite))
+}
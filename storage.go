@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MetaBucket keeps the information about the database itself, like the format of the records
+var MetaBucket = []byte("meta")
+
+var recordsFormatKey = []byte("records-format")
+
+// RecordsFormatWire is the format of the RRsets stored in the RecordBucket: a version byte followed
+// by the RRs in uncompressed wire format, one after the other. The legacy format is the JSON of the
+// dns.RR slice, which starts with '[' or 'n' (null) and can't be mistaken for a version byte.
+const RecordsFormatWire byte = 0x01
+
+// encodeRRs serialize a RRset to store it in the RecordBucket
+func encodeRRs(rrs []dns.RR) ([]byte, error) {
+	size := 1
+
+	for _, rr := range rrs {
+		size += dns.Len(rr)
+	}
+
+	raw := make([]byte, size)
+	raw[0] = RecordsFormatWire
+	off := 1
+
+	for _, rr := range rrs {
+		var err error
+		off, err = dns.PackRR(rr, raw, off, nil, false)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return raw[:off], nil
+}
+
+// decodeRRs deserialize a RRset of the RecordBucket, the qtype of its key is only needed for the legacy JSON format
+func decodeRRs(raw []byte, qtype uint16) ([]dns.RR, error) {
+	if len(raw) == 0 {
+		return []dns.RR{}, nil
+	}
+
+	if raw[0] != RecordsFormatWire {
+		return decodeJSONRRs(raw, qtype)
+	}
+
+	rrs := []dns.RR{}
+
+	for off := 1; off < len(raw); {
+		rr, next, err := dns.UnpackRR(raw, off)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rrs = append(rrs, rr)
+		off = next
+	}
+
+	return rrs, nil
+}
+
+// decodeJSONRRs deserialize a RRset stored in the legacy JSON format.
+// json.Unmarshal doesn't support interfaces like dns.RR, so each RR is unmarshaled
+// into the concrete type of the key, given by the dns library.
+func decodeJSONRRs(raw []byte, qtype uint16) (rrs []dns.RR, err error) {
+	if qtype == dns.TypeNone {
+		return nil, fmt.Errorf("can't unmarshal a RRset without type")
+	}
+
+	var rawRRs []json.RawMessage
+
+	if err = json.Unmarshal(raw, &rawRRs); err != nil {
+		return nil, err
+	}
+
+	for _, rawRR := range rawRRs {
+		rr := newRRWithType(qtype)
+
+		if err = json.Unmarshal(rawRR, rr); err != nil {
+			return nil, err
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return
+}
+
+// newRRWithType return an empty RR of the concrete type of the qtype.
+// The types unknown by the dns library are kept in the generic format of RFC 3597.
+func newRRWithType(qtype uint16) dns.RR {
+	if newRR, found := dns.TypeToRR[qtype]; found {
+		return newRR()
+	}
+
+	return new(dns.RFC3597)
+}
+
+// migrateRecordsFormat convert the RRsets stored in the legacy JSON format into the wire format.
+// It's done once, the format of the database is then kept in the MetaBucket.
+func migrateRecordsFormat(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(MetaBucket)
+
+		if err != nil {
+			return err
+		}
+
+		if format := meta.Get(recordsFormatKey); bytes.Equal(format, []byte{RecordsFormatWire}) {
+			return nil
+		}
+
+		b := tx.Bucket(RecordBucket)
+		migrated := map[string][]byte{}
+
+		err = b.ForEach(func(k, v []byte) error {
+			if len(v) == 0 || v[0] == RecordsFormatWire {
+				return nil
+			}
+
+			_, qtype := utils.ExtractQnameAndQtypeFromKey(k)
+			rrs, err := decodeJSONRRs(v, qtype)
+
+			if err != nil {
+				// The unreadable RRsets are left as is, they were already ignored by the lookups
+				log.WithField("key", string(k)).WithError(err).Error("Can't migrate the RRset in the wire format")
+				return nil
+			}
+
+			raw, err := encodeRRs(rrs)
+
+			if err != nil {
+				return err
+			}
+
+			migrated[string(k)] = raw
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// A bucket can't be modified while iterating over it with ForEach
+		for k, raw := range migrated {
+			if err = b.Put([]byte(k), raw); err != nil {
+				return err
+			}
+		}
+
+		log.WithField("rrsets", len(migrated)).Info("Migrated the records into the wire format")
+
+		return meta.Put(recordsFormatKey, []byte{RecordsFormatWire})
+	})
+}
+
+// NameBucket keeps the owner names of the RecordBucket in the canonical order: in lowercase, with the
+// labels reversed, e.g: www.foo.internal. -> .internal.foo.www. The keys of the RecordBucket are sorted
+// by owner name, so the descendants of a name aren't next to each other, here a prefix seek finds them.
+// The value is the number of RRsets owned by the name.
+var NameBucket = []byte("names")
+
+// canonicalName return the key of the name in the NameBucket, the key of a name is the prefix of the keys of its descendants
+func canonicalName(name string) []byte {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+
+	if len(labels) == 0 {
+		return []byte(".")
+	}
+
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return []byte("." + strings.Join(labels, ".") + ".")
+}
+
+// putRRset store a RRset in the RecordBucket and index its owner name
+func putRRset(tx *bolt.Tx, key []byte, raw []byte) error {
+	b := tx.Bucket(RecordBucket)
+	existed := b.Get(key) != nil
+
+	if err := b.Put(key, raw); err != nil || existed {
+		return err
+	}
+
+	name, _ := utils.ExtractQnameAndQtypeFromKey(key)
+	return countName(tx, name, 1)
+}
+
+// deleteRRset remove a RRset of the RecordBucket, the owner name leaves the index with its last RRset
+func deleteRRset(tx *bolt.Tx, key []byte) error {
+	b := tx.Bucket(RecordBucket)
+
+	if b.Get(key) == nil {
+		return nil
+	}
+
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+
+	name, _ := utils.ExtractQnameAndQtypeFromKey(key)
+	return countName(tx, name, -1)
+}
+
+// countName add delta to the number of RRsets owned by the name in the NameBucket
+func countName(tx *bolt.Tx, name string, delta int) error {
+	b, err := tx.CreateBucketIfNotExists(NameBucket)
+
+	if err != nil {
+		return err
+	}
+
+	key := canonicalName(name)
+	count := int64(delta)
+
+	if previous := b.Get(key); previous != nil {
+		count += int64(binary.BigEndian.Uint32(previous))
+	}
+
+	if count <= 0 {
+		return b.Delete(key)
+	}
+
+	raw := make([]byte, 4)
+	binary.BigEndian.PutUint32(raw, uint32(count))
+
+	return b.Put(key, raw)
+}
+
+// indexNames build the NameBucket of a database which doesn't have one yet, it's then kept up to date with the RRsets
+func indexNames(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(NameBucket) != nil {
+			return nil
+		}
+
+		if _, err := tx.CreateBucket(NameBucket); err != nil {
+			return err
+		}
+
+		counts := map[string]int{}
+
+		tx.Bucket(RecordBucket).ForEach(func(k, v []byte) error {
+			name, _ := utils.ExtractQnameAndQtypeFromKey(k)
+			counts[name]++
+			return nil
+		})
+
+		for name, count := range counts {
+			if err := countName(tx, name, count); err != nil {
+				return err
+			}
+		}
+
+		log.WithField("names", len(counts)).Info("Indexed the owner names of the records")
+
+		return nil
+	})
+}
+
+// hasDescendantsInBucket look if names below the qname own RRsets, with a prefix seek in the NameBucket
+func hasDescendantsInBucket(tx *bolt.Tx, qname string) bool {
+	b := tx.Bucket(NameBucket)
+
+	if b == nil {
+		return false
+	}
+
+	prefix := canonicalName(qname)
+	c := b.Cursor()
+	k, _ := c.Seek(prefix)
+
+	if bytes.Equal(k, prefix) {
+		k, _ = c.Next()
+	}
+
+	return k != nil && bytes.HasPrefix(k, prefix)
+}
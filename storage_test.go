@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestShouldEncodeAndDecodeTheRRsInWireFormat(t *testing.T) {
+	rrs := []dns.RR{
+		testRR("foo.internal. 2700 IN A 127.0.0.1"),
+		testRR("foo.internal. 2700 IN A 127.0.0.2"),
+	}
+
+	raw, err := encodeRRs(rrs)
+	assert.Nil(t, err)
+	assert.Equal(t, RecordsFormatWire, raw[0])
+
+	decoded, err := decodeRRs(raw, dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, len(rrs), len(decoded))
+
+	for i := range rrs {
+		assert.Equal(t, rrs[i].String(), decoded[i].String())
+	}
+
+	for _, rr := range []string{
+		"_sip._tcp.internal. 300 IN SRV 5 10 5060 sip.internal.",
+		"internal. 300 IN CAA 0 issue \"letsencrypt.org\"",
+		"foo.internal. 300 IN TXT \"foo\" \"bar\"",
+		"foo.internal. 300 IN TYPE65 \\# 3 000100",
+	} {
+		raw, err := encodeRRs([]dns.RR{testRR(rr)})
+		assert.Nil(t, err, rr)
+
+		decoded, err := decodeRRs(raw, testRR(rr).Header().Rrtype)
+		assert.Nil(t, err, rr)
+		assert.Equal(t, testRR(rr).String(), decoded[0].String())
+	}
+}
+
+func TestShouldDecodeTheRRsInTheLegacyJSONFormat(t *testing.T) {
+	raw, _ := json.Marshal([]dns.RR{testRR("foo.internal. 2700 IN MX 10 mail.internal.")})
+
+	decoded, err := decodeRRs(raw, dns.TypeMX)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo.internal.\t2700\tIN\tMX\t10 mail.internal.", decoded[0].String())
+
+	_, err = decodeRRs(raw, dns.TypeNone)
+	assert.NotNil(t, err)
+}
+
+func TestShouldMigrateTheLegacyJSONRecordsIntoTheWireFormat(t *testing.T) {
+	db := newTestDB()
+	defer closeTestDB(db)
+
+	legacy, _ := json.Marshal([]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")})
+	wire := testMarshalRR([]dns.RR{testRR("bar.internal. 2700 IN A 127.0.0.2")})
+
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RecordBucket)
+		b.Put([]byte("foo.internal.|A"), legacy)
+		b.Put([]byte("bar.internal.|A"), wire)
+		b.Put([]byte("broken.internal.|A"), []byte("[{"))
+		return nil
+	})
+
+	assert.Nil(t, migrateRecordsFormat(db))
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RecordBucket)
+
+		foo, err := decodeRRs(b.Get([]byte("foo.internal.|A")), dns.TypeA)
+		assert.Nil(t, err)
+		assert.Equal(t, RecordsFormatWire, b.Get([]byte("foo.internal.|A"))[0])
+		assert.Equal(t, "foo.internal.\t2700\tIN\tA\t127.0.0.1", foo[0].String())
+
+		assert.Equal(t, wire, b.Get([]byte("bar.internal.|A")))
+		assert.Equal(t, []byte("[{"), b.Get([]byte("broken.internal.|A")))
+		assert.Equal(t, []byte{RecordsFormatWire}, tx.Bucket(MetaBucket).Get(recordsFormatKey))
+		return nil
+	})
+}
+
+func TestShouldIndexTheOwnerNamesInTheCanonicalOrder(t *testing.T) {
+	assert.Equal(t, []byte(".internal.foo.www."), canonicalName("WWW.foo.internal."))
+	assert.Equal(t, []byte("."), canonicalName("."))
+
+	db := newTestDB()
+	defer closeTestDB(db)
+
+	raw := testMarshalRR([]dns.RR{testRR("_ssh._tcp.host.internal. 2700 IN SRV 0 0 22 host.internal.")})
+
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RecordBucket)
+		b.Put([]byte("_ssh._tcp.host.internal.|SRV"), raw)
+		b.Put([]byte("hostname.internal.|TXT"), raw)
+		return nil
+	})
+
+	assert.Nil(t, indexNames(db))
+
+	db.Update(func(tx *bolt.Tx) error {
+		assert.True(t, hasDescendantsInBucket(tx, "host.internal."))
+		assert.True(t, hasDescendantsInBucket(tx, "_TCP.host.internal."))
+		assert.False(t, hasDescendantsInBucket(tx, "_ssh._tcp.host.internal."), "a name isn't its own descendant")
+		assert.False(t, hasDescendantsInBucket(tx, "hostname.internal."))
+		assert.False(t, hasDescendantsInBucket(tx, "ost.internal."), "the names are matched label by label")
+
+		assert.Nil(t, putRRset(tx, []byte("_ssh._tcp.host.internal.|TXT"), raw))
+		assert.Nil(t, deleteRRset(tx, []byte("_ssh._tcp.host.internal.|SRV")))
+		assert.True(t, hasDescendantsInBucket(tx, "host.internal."), "the name still owns a RRset")
+
+		assert.Nil(t, deleteRRset(tx, []byte("_ssh._tcp.host.internal.|TXT")))
+		assert.False(t, hasDescendantsInBucket(tx, "host.internal."))
+		return nil
+	})
+}
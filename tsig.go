@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default algorithm of a TSIG key configured without algorithm
+const DefaultTsigAlgorithm = dns.HmacSHA256
+
+// Fudge of the TSIG RRs, the time difference allowed between the client and the server. c.f RFC 8945
+const TsigFudge = 300
+
+// TSIG algorithms supported by the dns library
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// TsigKey is a shared secret used to authenticate the transfers, the NOTIFY and the administrative queries. c.f RFC 8945
+type TsigKey struct {
+	Name      string // FQDN of the key, e.g: "transfer.internal."
+	Algorithm string // FQDN of the HMAC algorithm, e.g: "hmac-sha256."
+	Secret    string // base64 secret
+}
+
+// ParseTsigKey read a key with the format <name>:<algorithm>:<base64 secret>, or <name>:<base64 secret>
+// for a hmac-sha256 key, which is the format of the DNS_TSIG_KEYS setting.
+func ParseTsigKey(raw string) (TsigKey, error) {
+	parts := strings.Split(raw, ":")
+	key := TsigKey{Algorithm: DefaultTsigAlgorithm}
+
+	switch len(parts) {
+	case 2:
+		key.Name, key.Secret = parts[0], parts[1]
+	case 3:
+		algorithm, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(parts[1]), ".")]
+
+		if !ok {
+			return key, fmt.Errorf("unsupported TSIG algorithm %s for the key %s", parts[1], parts[0])
+		}
+
+		key.Name, key.Algorithm, key.Secret = parts[0], algorithm, parts[2]
+	default:
+		return key, fmt.Errorf("the TSIG key must have the format <name>:<algorithm>:<secret>")
+	}
+
+	if key.Name == "" {
+		return key, fmt.Errorf("the TSIG key has no name")
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil || key.Secret == "" {
+		return key, fmt.Errorf("the secret of the TSIG key %s must be encoded in base64", key.Name)
+	}
+
+	key.Name = utils.ToLowerFQDN(key.Name)
+
+	return key, nil
+}
+
+// ParseTsigKeys read the keyring of the configuration, indexed by the name of the keys
+func ParseTsigKeys(rawKeys []string) (map[string]TsigKey, error) {
+	keys := make(map[string]TsigKey, len(rawKeys))
+
+	for _, raw := range rawKeys {
+		key, err := ParseTsigKey(raw)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := keys[key.Name]; exists {
+			return nil, fmt.Errorf("the TSIG key %s is defined twice", key.Name)
+		}
+
+		keys[key.Name] = key
+	}
+
+	return keys, nil
+}
+
+// TsigSecret return the secrets of the keyring in the format of dns.Server.TsigSecret
+func (h *QuestionResolverHandler) TsigSecret() map[string]string {
+	if len(h.tsigKeys) == 0 {
+		return nil
+	}
+
+	secrets := make(map[string]string, len(h.tsigKeys))
+
+	for name, key := range h.tsigKeys {
+		secrets[name] = key.Secret
+	}
+
+	return secrets
+}
+
+// checkTsig verify the TSIG of a signed query, the signature itself is checked by the dns.Server.
+// It returns the TSIG error (BADKEY, BADSIG, BADTIME) or RcodeSuccess when the query isn't signed or is valid.
+func (h *QuestionResolverHandler) checkTsig(w dns.ResponseWriter, r *dns.Msg) uint16 {
+	tsig := r.IsTsig()
+
+	if tsig == nil {
+		return dns.RcodeSuccess
+	}
+
+	key, found := h.tsigKeys[strings.ToLower(tsig.Hdr.Name)]
+
+	if !found || !strings.EqualFold(key.Algorithm, tsig.Algorithm) {
+		return dns.RcodeBadKey
+	}
+
+	switch w.TsigStatus() {
+	case nil:
+		return dns.RcodeSuccess
+	case dns.ErrTime:
+		return dns.RcodeBadTime
+	case dns.ErrSecret, dns.ErrKeyAlg:
+		return dns.RcodeBadKey
+	default:
+		return dns.RcodeBadSig
+	}
+}
+
+// requireTsig check that a query for a protected operation (zone transfer, NOTIFY, update) is signed
+// with one of the allowed keys. Nothing is required when the operation has no allowed keys.
+// The TSIG itself must have been checked with checkTsig before.
+func requireTsig(r *dns.Msg, allowedKeys []string) error {
+	if len(allowedKeys) == 0 {
+		return nil
+	}
+
+	tsig := r.IsTsig()
+
+	if tsig == nil {
+		return fmt.Errorf("the query isn't signed with TSIG")
+	}
+
+	for _, name := range allowedKeys {
+		if utils.ToLowerFQDN(name) == strings.ToLower(tsig.Hdr.Name) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the TSIG key %s isn't allowed", tsig.Hdr.Name)
+}
+
+// writeTsigError answer NOTAUTH to a query with an invalid TSIG. c.f RFC 8945 section 5.2
+// The TSIG RR of the response carries the error and no MAC: we can't sign with a key we don't trust.
+func writeTsigError(w dns.ResponseWriter, r *dns.Msg, tsigError uint16) {
+	tsig := r.IsTsig()
+	msg := dns.Msg{}
+	msg.SetRcode(r, dns.RcodeNotAuth)
+	msg.Extra = append(msg.Extra, &dns.TSIG{
+		Hdr:        dns.RR_Header{Name: tsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm:  tsig.Algorithm,
+		TimeSigned: tsig.TimeSigned,
+		Fudge:      tsig.Fudge,
+		OrigId:     r.Id,
+		Error:      tsigError,
+	})
+
+	// The response is packed here, otherwise the dns.Server would try to sign it
+	raw, err := msg.Pack()
+
+	if err == nil {
+		_, err = w.Write(raw)
+	}
+
+	if err != nil {
+		log.WithField("ip", w.RemoteAddr().String()).Error(err)
+	}
+}
+
+// signResponse add a TSIG RR to the response of a signed query, the MAC is computed by the dns.Server when the message is written
+func signResponse(r *dns.Msg, msg *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil {
+		msg.SetTsig(tsig.Hdr.Name, tsig.Algorithm, TsigFudge, time.Now().Unix())
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// Secret of the TSIG keys used in the tests
+const testTsigSecret = "c2VjcmV0LW9mLXRoZS10cmFuc2Zlci1rZXk="
+
+func TestShouldParseTheTsigKeys(t *testing.T) {
+	key, err := ParseTsigKey("Transfer.Internal:hmac-sha512:" + testTsigSecret)
+	assert.Nil(t, err)
+	assert.Equal(t, TsigKey{Name: "transfer.internal.", Algorithm: dns.HmacSHA512, Secret: testTsigSecret}, key)
+
+	key, err = ParseTsigKey("transfer.internal.:" + testTsigSecret)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultTsigAlgorithm, key.Algorithm)
+
+	for _, raw := range []string{
+		"transfer.internal.",
+		"transfer.internal.:hmac-sha42:" + testTsigSecret,
+		"transfer.internal.:not base64",
+		":" + testTsigSecret,
+	} {
+		_, err = ParseTsigKey(raw)
+		assert.NotNil(t, err, raw)
+	}
+
+	_, err = ParseTsigKeys([]string{"transfer.internal.:" + testTsigSecret, "transfer.internal:" + testTsigSecret})
+	assert.NotNil(t, err)
+}
+
+func TestShouldRequireATsigKeyAllowedForTheOperation(t *testing.T) {
+	r := new(dns.Msg).SetAxfr("internal.")
+	assert.Nil(t, requireTsig(r, nil))
+	assert.NotNil(t, requireTsig(r, []string{"transfer.internal."}))
+
+	r.SetTsig("other.internal.", dns.HmacSHA256, TsigFudge, 0)
+	assert.NotNil(t, requireTsig(r, []string{"transfer.internal."}))
+	assert.Nil(t, requireTsig(r, []string{"transfer.internal.", "Other.Internal"}))
+}
@@ -2,9 +2,11 @@ package utils
 
 import (
 	"bytes"
-	"fmt"
 	"math/rand"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	dns "github.com/miekg/dns"
 )
@@ -51,7 +53,29 @@ func ToLowerFQDN(name string) string {
 // NOTE: the qname will keep the trailing dot, use the method TrimTrailingDotsInDomain to remove it
 func ExtractQnameAndQtypeFromKey(key []byte) (string, uint16) {
 	res := bytes.Split(key, []byte(".|"))
-	return string(res[0]), dns.StringToType[string(res[1])]
+	qtype, _ := StringToType(string(res[1]))
+	return string(res[0]), qtype
+}
+
+// TypeToString return the mnemonic of the type, or TYPE<number> for an unknown type. c.f RFC 3597 section 5
+func TypeToString(qtype uint16) string {
+	return dns.Type(qtype).String()
+}
+
+// StringToType return the type of the mnemonic, which can also have the generic format TYPE<number>
+func StringToType(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+
+	if qtype, found := dns.StringToType[name]; found {
+		return qtype, true
+	}
+
+	if strings.HasPrefix(name, "TYPE") {
+		qtype, err := strconv.ParseUint(name[len("TYPE"):], 10, 16)
+		return uint16(qtype), err == nil
+	}
+
+	return 0, false
 }
 
 // Remove the trailing dot in a domain
@@ -93,11 +117,6 @@ func RRsIntoString(rrs []dns.RR) (res string) {
 	return
 }
 
-// IntoWildcardQname return the
-func IntoWildcardQname(qname string) string {
-	return fmt.Sprintf("*%s", qname[strings.Index(qname, "."):len(qname)-1])
-}
-
 // IsAWildcardRR look if the first subdomain in the qname is the wildcard token: *
 // The contents of the wildcard RRs follows the usual rules and formats for
 // RRs. The wildcards in the zone have an owner name that controls the
@@ -119,7 +138,7 @@ func GetZoneFromQname(qname string) string {
 // Key return a consumer key with the format <qname.|qtype> from a qname and qtype
 // e.g: foo.com, A -> foo.com.|A
 func Key(qname string, qtype uint16) []byte {
-	return []byte(dns.Fqdn(qname) + "|" + dns.TypeToString[qtype])
+	return []byte(dns.Fqdn(qname) + "|" + TypeToString(qtype))
 }
 
 // IsALocalRR look if the qname is a domain of one of this domain zones
@@ -127,13 +146,121 @@ func Key(qname string, qtype uint16) []byte {
 // test.io, (.io, .com) -> true
 // test.fr, (.io, .com) -> false
 func IsALocalRR(qname string, zones []string) (isLocal bool) {
-	isLocal = false
+	_, isLocal = FindZone(qname, zones)
+	return
+}
 
+// ZoneApex return the apex of a zone as it's written in the configuration
+// e.g: .bar.services.com. -> bar.services.com.
+func ZoneApex(zone string) string {
+	return ToLowerFQDN(strings.TrimPrefix(zone, "."))
+}
+
+// FindZone return the apex of the closest zone, among the managed zones, which contains the qname.
+// The match is done label by label, so foo.io. is not in the zone o.io.
+// e.g: www.foo.bar.com., (bar.com., foo.bar.com.) -> foo.bar.com.
+func FindZone(qname string, zones []string) (apex string, found bool) {
 	for _, zone := range zones {
-		if strings.HasSuffix(qname, zone) {
-			isLocal = true
+		zoneApex := ZoneApex(zone)
+
+		if dns.IsSubDomain(zoneApex, qname) && len(zoneApex) > len(apex) {
+			apex = zoneApex
+			found = true
 		}
 	}
 
 	return
 }
+
+// ParseCIDRs parse a list of networks in the CIDR notation.
+// A single IP is accepted as a network which only contains this IP.
+// e.g: 10.0.0.1 -> 10.0.0.1/32
+func ParseCIDRs(cidrs []string) (networks []*net.IPNet, err error) {
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return
+}
+
+// ContainsIP look if the ip belongs to one of the networks
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IPFromAddr return the IP of a network address, nil if the address doesn't have one
+func IPFromAddr(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+
+	if err != nil {
+		return net.ParseIP(addr.String())
+	}
+
+	return net.ParseIP(host)
+}
+
+// TokenBucket gets rate tokens by second, up to burst tokens, e.g: to limit the queries of a client
+type TokenBucket struct {
+	tokens float64
+	last   time.Time // last refill
+}
+
+// NewTokenBucket create a full bucket
+func NewTokenBucket(now time.Time, burst float64) *TokenBucket {
+	return &TokenBucket{tokens: burst, last: now}
+}
+
+// Take remove a token from the bucket, it returns false when the bucket is empty
+func (b *TokenBucket) Take(now time.Time, rate float64, burst float64) bool {
+	b.refill(now, rate, burst)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// Full look if the bucket is full again, it's the same as a new one
+func (b *TokenBucket) Full(now time.Time, rate float64, burst float64) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+func (b *TokenBucket) refill(now time.Time, rate float64, burst float64) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		b.last = now
+	}
+
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
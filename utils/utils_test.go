@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -26,7 +28,76 @@ func TestExtractQnameAndQtypeFromConsumerKey(t *testing.T) {
 	assert.Equal(t, dns.TypeCNAME, qtype)
 }
 
+func TestShouldConvertTheTypesWithTheirGenericFormat(t *testing.T) {
+	assert.Equal(t, "SRV", TypeToString(dns.TypeSRV))
+	assert.Equal(t, "HTTPS", TypeToString(dns.TypeHTTPS))
+	assert.Equal(t, "TYPE4242", TypeToString(4242))
+
+	for name, expected := range map[string]uint16{"caa": dns.TypeCAA, "SVCB": dns.TypeSVCB, "TYPE4242": 4242} {
+		qtype, found := StringToType(name)
+		assert.True(t, found, name)
+		assert.Equal(t, expected, qtype)
+	}
+
+	_, found := StringToType("FOO")
+	assert.False(t, found)
+
+	qname, qtype := ExtractQnameAndQtypeFromKey([]byte("www.example.com.|HTTPS"))
+	assert.Equal(t, "www.example.com", qname)
+	assert.Equal(t, dns.TypeHTTPS, qtype)
+}
+
 func TestTrimRemoveTrailingDotInDomain(t *testing.T) {
 	assert.Equal(t, "www.example.com", TrimTrailingDotInDomain("www.example.com."))
 	assert.Equal(t, "www.example.com", TrimTrailingDotInDomain("www.example.com"))
 }
+
+func TestShouldFindTheClosestZoneOfAQname(t *testing.T) {
+	zones := []string{".bar.com.", "foo.bar.com.", "internal."}
+
+	zone, found := FindZone("www.foo.bar.com.", zones)
+	assert.True(t, found)
+	assert.Equal(t, "foo.bar.com.", zone)
+
+	zone, found = FindZone("bar.com.", zones)
+	assert.True(t, found)
+	assert.Equal(t, "bar.com.", zone)
+
+	_, found = FindZone("notinternal.", zones)
+	assert.False(t, found)
+}
+
+func TestShouldMatchAnIPWithTheCIDRs(t *testing.T) {
+	networks, err := ParseCIDRs([]string{"10.0.0.0/24", "192.168.1.1", "2001:db8::/32"})
+	assert.Nil(t, err)
+
+	assert.True(t, ContainsIP(networks, net.ParseIP("10.0.0.42")))
+	assert.True(t, ContainsIP(networks, net.ParseIP("192.168.1.1")))
+	assert.True(t, ContainsIP(networks, net.ParseIP("2001:db8::1")))
+	assert.False(t, ContainsIP(networks, net.ParseIP("192.168.1.2")))
+
+	_, err = ParseCIDRs([]string{"not an ip"})
+	assert.NotNil(t, err)
+}
+
+func TestShouldRefillTheTokenBucketAtItsRate(t *testing.T) {
+	now := time.Now()
+	bucket := NewTokenBucket(now, 2)
+
+	assert.True(t, bucket.Take(now, 1, 2))
+	assert.True(t, bucket.Take(now, 1, 2))
+	assert.False(t, bucket.Take(now, 1, 2))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.False(t, bucket.Take(now, 1, 2))
+	assert.False(t, bucket.Full(now, 1, 2))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, bucket.Take(now, 1, 2))
+
+	now = now.Add(time.Hour)
+	assert.True(t, bucket.Full(now, 1, 2))
+	assert.True(t, bucket.Take(now, 1, 2))
+	assert.True(t, bucket.Take(now, 1, 2))
+	assert.False(t, bucket.Take(now, 1, 2), "the tokens are bounded by the burst")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Reasons of the rejection of a query.
+// They are used as metric names to count the rejected queries.
+const (
+	RejectUnsupportedOpcode = "query-rejected-unsupported-opcode"
+	RejectNoQuestion        = "query-rejected-no-question"
+	RejectManyQuestions     = "query-rejected-many-questions"
+	RejectUnexpectedRecords = "query-rejected-unexpected-records"
+	RejectUnsupportedClass  = "query-rejected-unsupported-class"
+	RejectInvalidTsig       = "query-rejected-invalid-tsig"
+	RejectRecursion         = "query-rejected-recursion"
+)
+
+// acceptQueryFunc replaces the default dns.MsgAcceptFunc of the servers.
+// The queries are validated by the QuestionResolverHandler to count the rejections,
+// so we only ignore the responses that we must never answer.
+func acceptQueryFunc(dh dns.Header) dns.MsgAcceptAction {
+	if isResponse := dh.Bits&(1<<15) != 0; isResponse {
+		return dns.MsgIgnore
+	}
+
+	return dns.MsgAccept
+}
+
+// validateQuery check that we can answer the query.
+// It returns RcodeSuccess for a valid query, otherwise the rcode of the rejection and its reason.
+func validateQuery(r *dns.Msg) (rcode int, reason string) {
+	// UPDATE, NOTIFY and the obsolete IQUERY aren't supported
+	if r.Opcode != dns.OpcodeQuery {
+		return dns.RcodeNotImplemented, RejectUnsupportedOpcode
+	}
+
+	if len(r.Question) == 0 {
+		return dns.RcodeFormatError, RejectNoQuestion
+	}
+
+	// In practice, nobody supports many questions in a query. c.f RFC 1035 section 4.1.2
+	if len(r.Question) > 1 {
+		return dns.RcodeFormatError, RejectManyQuestions
+	}
+
+	// A query can only have the OPT and TSIG RRs in its additional section,
+	// and a SOA in its authority section for IXFR. c.f RFC 1995
+	if len(r.Answer) > 0 || len(r.Ns) > 1 || len(r.Extra) > 2 {
+		return dns.RcodeFormatError, RejectUnexpectedRecords
+	}
+
+	if r.Question[0].Qclass != dns.ClassINET {
+		return dns.RcodeRefused, RejectUnsupportedClass
+	}
+
+	return dns.RcodeSuccess, ""
+}
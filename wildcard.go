@@ -0,0 +1,89 @@
+package main
+
+import (
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
+)
+
+// wildcardSource return the wildcard which synthesizes the answers of a qname missing in its zone,
+// which is the "*" label under the closest encloser of the qname. c.f RFC 4592 section 3.3.1
+// There is no synthesis when the qname exists, even as an empty non-terminal, when the wildcard doesn't
+// exist or when the closest encloser is below a zone cut.
+func (h *QuestionResolverHandler) wildcardSource(qname string) (string, bool) {
+	qname = utils.ToLowerFQDN(qname)
+	zone, found := utils.FindZone(qname, h.config.Zones)
+
+	if !found || h.nameExistsInZone(qname) {
+		return "", false
+	}
+
+	encloser, found := h.closestEncloser(qname, zone)
+
+	if !found {
+		return "", false
+	}
+
+	source := "*." + encloser
+
+	if encloser == "." {
+		source = "*."
+	}
+
+	return source, len(h.typesAtName(source)) > 0
+}
+
+// closestEncloser walk up the labels of the qname, up to the zone apex, to find its closest existing ancestor.
+// An empty non-terminal is an existing ancestor and stops the walk. A delegation stops it too,
+// the names below a zone cut aren't authoritative data. c.f RFC 4592 section 3.3.1
+func (h *QuestionResolverHandler) closestEncloser(qname string, zone string) (string, bool) {
+	for name, ok := utils.Parent(qname); ok && dns.IsSubDomain(zone, name); name, ok = utils.Parent(name) {
+		if name == zone {
+			return zone, true
+		}
+
+		types := h.typesAtName(name)
+
+		if containsType(types, dns.TypeNS) {
+			return "", false
+		}
+
+		if len(types) > 0 || h.hasDescendants(name) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// nameExistsInZone look if the name owns RRs or is an empty non-terminal
+func (h *QuestionResolverHandler) nameExistsInZone(name string) bool {
+	return len(h.typesAtName(name)) > 0 || h.hasDescendants(name)
+}
+
+// hasDescendants look if names below the qname own RRs in the local DB
+func (h *QuestionResolverHandler) hasDescendants(qname string) bool {
+	if h.zoneCache != nil {
+		return h.zoneCache.HasDescendants(qname)
+	}
+
+	found := false
+
+	h.db.View(func(tx *bolt.Tx) error {
+		found = hasDescendantsInBucket(tx, qname)
+		return nil
+	})
+
+	return found
+}
+
+func containsType(types []uint16, qtype uint16) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+
+	return false
+}
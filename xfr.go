@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Maximum size of the RRs sent in one message of a zone transfer
+const MaxTransferMsgSize = 16 * 1024
+
+// serveZoneTransfer answer to the AXFR and IXFR queries. c.f RFC 5936 and RFC 1995
+// The content of the zone is read from the local DB and the differences for the IXFR from the journal.
+func (h *QuestionResolverHandler) serveZoneTransfer(w dns.ResponseWriter, r *dns.Msg, requestID string) {
+	question := r.Question[0]
+	zone := utils.ToLowerFQDN(question.Name)
+	logger := log.WithFields(log.Fields{
+		"ip":         w.RemoteAddr().String(),
+		"request-id": requestID,
+		"zone":       zone,
+		"qtype":      dns.TypeToString[question.Qtype],
+	})
+
+	if err := h.checkZoneTransferAllowed(w, r); err != nil {
+		logger.WithError(err).Warn("Refused a zone transfer")
+		h.incMetric("zone-transfer-refused")
+		h.writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	if apex, found := utils.FindZone(zone, h.config.Zones); !found || apex != zone {
+		logger.Warn("Refused a zone transfer for a non-managed zone")
+		h.writeRcode(w, r, dns.RcodeNotAuth)
+		return
+	}
+
+	soa := h.getSOAForTheZone(zone)
+
+	if soa == nil {
+		logger.Error("Can't transfer a zone without SOA")
+		h.writeRcode(w, r, dns.RcodeServerFailure)
+		return
+	}
+
+	var rrs []dns.RR
+
+	if question.Qtype == dns.TypeIXFR {
+		h.incMetric("zone-transfer-ixfr")
+
+		// Over UDP, we only tell the current version of the zone and the secondary retries over TCP. c.f RFC 1995 section 2
+		if !isTCP(w) {
+			msg := dns.Msg{}
+			msg.SetReply(r)
+			msg.Authoritative = true
+			msg.Answer = []dns.RR{soa}
+			signResponse(r, &msg)
+			w.WriteMsg(&msg)
+			return
+		}
+
+		rrs = h.incrementalZoneTransfer(zone, r, soa.(*dns.SOA))
+	} else {
+		h.incMetric("zone-transfer-axfr")
+	}
+
+	// The server can answer to an IXFR with the whole zone when it doesn't have the differences.
+	if rrs == nil {
+		var err error
+		rrs, err = h.fullZoneTransfer(zone, soa)
+
+		if err != nil {
+			logger.Error(err)
+			h.writeRcode(w, r, dns.RcodeServerFailure)
+			return
+		}
+	}
+
+	if err := sendZoneTransfer(w, r, rrs); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	logger.WithField("rrs", len(rrs)).Info("Transferred a zone")
+}
+
+// checkZoneTransferAllowed return why the client can't transfer the zone, or nil when it can
+func (h *QuestionResolverHandler) checkZoneTransferAllowed(w dns.ResponseWriter, r *dns.Msg) error {
+	if !h.config.Xfr.Allow {
+		return fmt.Errorf("zone transfers are disabled, set %s=true to enable them", formatConfig(ALLOW_AXFR))
+	}
+
+	if r.Question[0].Qtype == dns.TypeAXFR && !isTCP(w) {
+		return fmt.Errorf("AXFR is only allowed over TCP")
+	}
+
+	// The ACL is never empty: the secondaries are in the private networks unless they're configured
+	if !utils.ContainsIP(h.xfrACL, utils.IPFromAddr(w.RemoteAddr())) {
+		return fmt.Errorf("the client isn't in the allowed secondaries")
+	}
+
+	return requireTsig(r, h.config.Xfr.TsigKeys)
+}
+
+// fullZoneTransfer return all the RRs of the zone between two SOA.
+// The ALIAS is a private type which the secondaries don't know, it's flattened into the addresses
+// of its target at the time of the transfer.
+func (h *QuestionResolverHandler) fullZoneTransfer(zone string, soa dns.RR) (rrs []dns.RR, err error) {
+	rrs = []dns.RR{soa}
+	aliases := []dns.RR{}
+
+	err = h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(RecordBucket).Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			qname, qtype := utils.ExtractQnameAndQtypeFromKey(k)
+
+			if qtype == dns.TypeSOA || !dns.IsSubDomain(zone, dns.Fqdn(qname)) {
+				continue
+			}
+
+			// The records of a sub-zone managed by the instance aren't part of the zone
+			if subzone, _ := utils.FindZone(dns.Fqdn(qname), h.config.Zones); subzone != zone {
+				continue
+			}
+
+			zoneRRs, err := mapPairKeyRawRRsIntoRR(PairKeyRRraw{key: k, rrsRaw: v})
+
+			if err != nil {
+				return err
+			}
+
+			if qtype == TypeALIAS {
+				aliases = append(aliases, zoneRRs...)
+			} else {
+				rrs = append(rrs, zoneRRs...)
+			}
+		}
+
+		return nil
+	})
+
+	// The lookup of the target reads the DB, it's done out of the transaction
+	for _, alias := range aliases {
+		rrs = append(rrs, h.flattenAliasForTransfer(alias)...)
+	}
+
+	return append(rrs, soa), err
+}
+
+// flattenAliasForTransfer return the addresses of the target of the ALIAS, for the types that its owner doesn't have itself
+func (h *QuestionResolverHandler) flattenAliasForTransfer(alias dns.RR) (rrs []dns.RR) {
+	name := dns.Fqdn(alias.Header().Name)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if len(h.localRRset(name, qtype)) > 0 {
+			continue
+		}
+
+		addresses, err := h.flattenAlias(name, qtype, alias, 0)
+
+		if err != nil {
+			// The zone is still transferred, without the addresses of this target
+			log.WithFields(log.Fields{"name": name, "qtype": dns.TypeToString[qtype]}).WithError(err).Error("Can't flatten the ALIAS of the zone transfer")
+			continue
+		}
+
+		rrs = append(rrs, addresses...)
+	}
+
+	return
+}
+
+// incrementalZoneTransfer return the differences between the version of the secondary, given
+// by the SOA in the authority section of the query, and the current version of the zone.
+// It returns nil if the journal doesn't have these differences.
+func (h *QuestionResolverHandler) incrementalZoneTransfer(zone string, r *dns.Msg, soa *dns.SOA) []dns.RR {
+	if len(r.Ns) == 0 {
+		return nil
+	}
+
+	secondarySOA, ok := r.Ns[0].(*dns.SOA)
+
+	if !ok {
+		return nil
+	}
+
+	// The secondary is up to date
+	if secondarySOA.Serial == soa.Serial {
+		return []dns.RR{soa}
+	}
+
+	entries, found := readJournalChain(h.db, zone, secondarySOA.Serial, soa.Serial)
+
+	if !found {
+		return nil
+	}
+
+	rrs := []dns.RR{soa}
+
+	for _, entry := range entries {
+		diff := append([]string{entry.FromSOA}, entry.Deleted...)
+		diff = append(diff, entry.ToSOA)
+		diff = append(diff, entry.Added...)
+
+		for _, rawRR := range diff {
+			rr, err := dns.NewRR(rawRR)
+
+			if err != nil {
+				log.WithField("zone", zone).Error(err)
+				return nil
+			}
+
+			// The ALIAS is flattened, a change of its target is only transferred with the whole zone
+			if rr.Header().Rrtype == TypeALIAS {
+				return nil
+			}
+
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return append(rrs, soa)
+}
+
+// sendZoneTransfer stream the RRs to the secondary in several messages
+func sendZoneTransfer(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) error {
+	ch := make(chan *dns.Envelope)
+	errc := make(chan error, 1)
+	tr := new(dns.Transfer)
+
+	go func() {
+		errc <- tr.Out(w, r, ch)
+	}()
+
+	envelope := &dns.Envelope{}
+	size := 0
+
+	for i, rr := range rrs {
+		envelope.RR = append(envelope.RR, rr)
+		size += dns.Len(rr)
+
+		if size < MaxTransferMsgSize && i < len(rrs)-1 {
+			continue
+		}
+
+		select {
+		case ch <- envelope:
+		case err := <-errc:
+			return err
+		}
+
+		envelope = &dns.Envelope{}
+		size = 0
+	}
+
+	close(ch)
+
+	return <-errc
+}
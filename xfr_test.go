@@ -0,0 +1,208 @@
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type ZoneTransferTestSuite struct {
+	suite.Suite
+	handler  QuestionResolverHandler
+	consumer *KafkaConsumer
+}
+
+func (suite *ZoneTransferTestSuite) SetupTest() {
+	db := newTestDB()
+
+	config := DnsConfig{
+		Zones: []string{"internal."},
+		Xfr:   XfrConfig{Allow: true, AllowedIPs: []string{"127.0.0.0/8"}},
+	}
+
+	suite.handler = NewQuestionResolverHandler(db, nil, nil, config, nil)
+	suite.consumer = &KafkaConsumer{db: db, zones: config.Zones}
+
+	// Each change bumps the serial: the zone is at the serial 3 after the setup
+	suite.register("internal.|SOA", testRR("internal. 3600 IN SOA ns.internal. admin.internal. 1 7200 3600 1209600 300"))
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.1"))
+	suite.register("bar.internal.|TXT", testRR("bar.internal. 2700 IN TXT \"bar\""))
+}
+
+func (suite *ZoneTransferTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *ZoneTransferTestSuite) register(key string, rrs ...dns.RR) {
+	suite.Nil(suite.consumer.registerRecordAsBytesWithTheKeyInDB([]byte(key), rrs, false))
+}
+
+func (suite *ZoneTransferTestSuite) transfer(w *testResponseWriter, r *dns.Msg) (rrs []dns.RR) {
+	suite.handler.ServeDNS(w, r)
+
+	for _, msg := range w.msgs {
+		suite.Equal(dns.RcodeSuccess, msg.Rcode)
+		rrs = append(rrs, msg.Answer...)
+	}
+
+	return
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldTransferTheWholeZone() {
+	rrs := suite.transfer(newTestTCPResponseWriter(), new(dns.Msg).SetAxfr("internal."))
+
+	suite.Equal(4, len(rrs))
+	suite.Equal(dns.TypeSOA, rrs[0].Header().Rrtype)
+	suite.Equal(dns.TypeSOA, rrs[3].Header().Rrtype)
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldRefuseATransferWhenItIsDisabled() {
+	suite.handler.config.Xfr.Allow = false
+	w := newTestTCPResponseWriter()
+
+	suite.handler.ServeDNS(w, new(dns.Msg).SetAxfr("internal."))
+
+	suite.Equal(dns.RcodeRefused, w.msg.Rcode)
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldRefuseATransferToAClientOutsideTheACL() {
+	w := newTestTCPResponseWriter()
+	w.remoteAddr = &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 4242}
+
+	suite.handler.ServeDNS(w, new(dns.Msg).SetAxfr("internal."))
+
+	suite.Equal(dns.RcodeRefused, w.msg.Rcode)
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldOnlyTransferToThePrivateNetworksWithoutACL() {
+	config := DnsConfig{Zones: []string{"internal."}, Xfr: XfrConfig{Allow: true}}
+	handler := NewQuestionResolverHandler(suite.handler.db, nil, nil, config, nil)
+
+	w := newTestTCPResponseWriter()
+	w.remoteAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}
+	handler.ServeDNS(w, new(dns.Msg).SetAxfr("internal."))
+	suite.Equal(dns.RcodeRefused, w.msg.Rcode, "the zones aren't given to anyone")
+
+	w = newTestTCPResponseWriter()
+	w.remoteAddr = &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4242}
+	handler.ServeDNS(w, new(dns.Msg).SetAxfr("internal."))
+	suite.Equal(dns.RcodeSuccess, w.msg.Rcode)
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldRefuseAnAXFROverUDP() {
+	w := newTestUDPResponseWriter()
+
+	suite.handler.ServeDNS(w, new(dns.Msg).SetAxfr("internal."))
+
+	suite.Equal(dns.RcodeRefused, w.msg.Rcode)
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldRequireTsigWhenTheTransfersAreRestrictedToKeys() {
+	suite.handler.tsigKeys, _ = ParseTsigKeys([]string{"transfer.internal.:" + testTsigSecret, "other.internal.:" + testTsigSecret})
+	suite.handler.config.Xfr.TsigKeys = []string{"transfer.internal."}
+
+	w := newTestTCPResponseWriter()
+	suite.handler.ServeDNS(w, new(dns.Msg).SetAxfr("internal."))
+	suite.Equal(dns.RcodeRefused, w.msg.Rcode)
+
+	w = newTestTCPResponseWriter()
+	suite.handler.ServeDNS(w, new(dns.Msg).SetAxfr("internal.").SetTsig("other.internal.", dns.HmacSHA256, TsigFudge, time.Now().Unix()))
+	suite.Equal(dns.RcodeRefused, w.msg.Rcode)
+
+	r := new(dns.Msg).SetAxfr("internal.").SetTsig("transfer.internal.", dns.HmacSHA256, TsigFudge, time.Now().Unix())
+	rrs := suite.transfer(newTestTCPResponseWriter(), r)
+	suite.Equal(4, len(rrs))
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldTransferTheDifferencesFromTheJournal() {
+	suite.register("foo.internal.|A", testRR("foo.internal. 2700 IN A 127.0.0.2"))
+	suite.register("baz.internal.|A", testRR("baz.internal. 2700 IN A 127.0.0.3"))
+
+	rrs := suite.transfer(newTestTCPResponseWriter(), new(dns.Msg).SetIxfr("internal.", 3, "ns.internal.", "admin.internal."))
+
+	expected := []string{
+		"internal.\t3600\tIN\tSOA\tns.internal. admin.internal. 5 7200 3600 1209600 300",
+		"internal.\t3600\tIN\tSOA\tns.internal. admin.internal. 3 7200 3600 1209600 300",
+		"foo.internal.\t2700\tIN\tA\t127.0.0.1",
+		"internal.\t3600\tIN\tSOA\tns.internal. admin.internal. 4 7200 3600 1209600 300",
+		"foo.internal.\t2700\tIN\tA\t127.0.0.2",
+		"internal.\t3600\tIN\tSOA\tns.internal. admin.internal. 4 7200 3600 1209600 300",
+		"internal.\t3600\tIN\tSOA\tns.internal. admin.internal. 5 7200 3600 1209600 300",
+		"baz.internal.\t2700\tIN\tA\t127.0.0.3",
+		"internal.\t3600\tIN\tSOA\tns.internal. admin.internal. 5 7200 3600 1209600 300",
+	}
+
+	suite.Equal(len(expected), len(rrs))
+
+	for i, rr := range rrs {
+		suite.Equal(expected[i], rr.String())
+	}
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldTransferTheWholeZoneWhenTheJournalDoesNotHaveTheVersion() {
+	rrs := suite.transfer(newTestTCPResponseWriter(), new(dns.Msg).SetIxfr("internal.", 42, "ns.internal.", "admin.internal."))
+
+	suite.Equal(4, len(rrs))
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldOnlyAnswerTheSOAWhenTheSecondaryIsUpToDate() {
+	rrs := suite.transfer(newTestTCPResponseWriter(), new(dns.Msg).SetIxfr("internal.", 3, "ns.internal.", "admin.internal."))
+
+	suite.Equal(1, len(rrs))
+	suite.Equal(dns.TypeSOA, rrs[0].Header().Rrtype)
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldKeepTheLatestVersionsInTheJournalWhenTheSerialWraps() {
+	soa := func(serial uint32) *dns.SOA {
+		rr := testRR("other. 3600 IN SOA ns.other. admin.other. 1 7200 3600 1209600 300").(*dns.SOA)
+		rr.Serial = serial
+		return rr
+	}
+
+	first := uint32(math.MaxUint32 - MaxJournalVersions/2)
+	last := first + MaxJournalVersions + 10
+
+	suite.handler.db.Update(func(tx *bolt.Tx) error {
+		for serial := first; serial != last; serial++ {
+			if err := closeJournalVersion(tx, "other.", soa(serial), soa(serial+1)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	_, found := readJournalChain(suite.handler.db, "other.", last-MaxJournalVersions, last)
+	suite.True(found, "the versions after the wrap are the latest")
+
+	_, found = readJournalChain(suite.handler.db, "other.", first, last)
+	suite.False(found, "the oldest versions are pruned")
+}
+
+func (suite *ZoneTransferTestSuite) TestShouldTransferTheALIASFlattened() {
+	suite.register("internal.|ALIAS", testRR("internal. 300 IN ALIAS foo.internal."))
+
+	for _, r := range []*dns.Msg{
+		new(dns.Msg).SetAxfr("internal."),
+		// The journal has the ALIAS, the whole zone is transferred
+		new(dns.Msg).SetIxfr("internal.", 3, "ns.internal.", "admin.internal."),
+	} {
+		rrs := suite.transfer(newTestTCPResponseWriter(), r)
+		suite.Equal(5, len(rrs))
+
+		for _, rr := range rrs {
+			suite.NotEqual(TypeALIAS, rr.Header().Rrtype, "the secondaries don't know the private type")
+		}
+
+		suite.Equal("internal.\t300\tIN\tA\t127.0.0.1", rrs[3].String())
+	}
+}
+
+func TestZoneTransferTestSuite(t *testing.T) {
+	suite.Run(t, new(ZoneTransferTestSuite))
+}
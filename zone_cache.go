@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"stream-dns/utils"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ZoneCache keeps in memory the RRsets of the local DB, so the queries don't open a bbolt transaction
+// nor decode the RRsets. bbolt stays the persistence layer: the cache is loaded from it at startup and
+// the consumer refreshes the names it has changed after each commit.
+//
+// The RRsets of a name are never modified once published: a refresh builds a new cachedName
+// and replaces the previous one, so the readers never take a lock (read-copy-update).
+type ZoneCache struct {
+	names       sync.Map   // owner name in lowercase -> *cachedName
+	descendants sync.Map   // name -> number of names below it which own RRs, to find the empty non-terminals
+	mutex       sync.Mutex // serializes the refreshes
+}
+
+// cachedName is the immutable set of the RRsets owned by a name, indexed by type
+type cachedName struct {
+	rrsets map[uint16][]dns.RR
+	types  []uint16 // sorted
+}
+
+// NewZoneCache load all the RRsets of the DB in memory
+func NewZoneCache(db *bolt.DB) (*ZoneCache, error) {
+	cache := &ZoneCache{}
+	names := map[string]map[uint16][]dns.RR{}
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(RecordBucket).ForEach(func(k, v []byte) error {
+			qname, qtype := utils.ExtractQnameAndQtypeFromKey(k)
+			rrs, err := mapPairKeyRawRRsIntoRR(PairKeyRRraw{key: k, rrsRaw: v})
+
+			if err != nil {
+				log.WithField("key", string(k)).Error(err)
+				return nil
+			}
+
+			name := utils.ToLowerFQDN(qname)
+
+			if names[name] == nil {
+				names[name] = map[uint16][]dns.RR{}
+			}
+
+			names[name][qtype] = append(names[name][qtype], rrs...)
+			return nil
+		})
+	})
+
+	for name, rrsets := range names {
+		cache.names.Store(name, newCachedName(rrsets))
+		cache.countDescendant(name, 1)
+	}
+
+	log.WithField("names", len(names)).Info("Loaded the zones in memory")
+
+	return cache, err
+}
+
+func newCachedName(rrsets map[uint16][]dns.RR) *cachedName {
+	name := &cachedName{rrsets: rrsets}
+
+	for qtype := range rrsets {
+		name.types = append(name.types, qtype)
+	}
+
+	sort.Slice(name.types, func(i, j int) bool { return name.types[i] < name.types[j] })
+
+	return name
+}
+
+// Refresh reload from the DB the RRsets of the names, it's called after each commit which changes them
+func (c *ZoneCache) Refresh(db *bolt.DB, names ...string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RecordBucket)
+
+		for _, changed := range names {
+			name := utils.ToLowerFQDN(changed)
+			rrsets := map[uint16][]dns.RR{}
+
+			// The keys of the DB keep the case of the owner names, a RRset of the name can also be under the lowercase one
+			for _, owner := range []string{dns.Fqdn(changed), name} {
+				prefix := []byte(owner + "|")
+				cursor := b.Cursor()
+
+				for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+					_, qtype := utils.ExtractQnameAndQtypeFromKey(k)
+					rrs, err := mapPairKeyRawRRsIntoRR(PairKeyRRraw{key: k, rrsRaw: v})
+
+					if err != nil {
+						log.WithField("key", string(k)).Error(err)
+						continue
+					}
+
+					rrsets[qtype] = append(rrsets[qtype], rrs...)
+				}
+
+				if owner == name {
+					break
+				}
+			}
+
+			_, existed := c.names.Load(name)
+
+			if len(rrsets) == 0 {
+				c.names.Delete(name)
+			} else {
+				c.names.Store(name, newCachedName(rrsets))
+			}
+
+			if exists := len(rrsets) > 0; exists != existed {
+				if exists {
+					c.countDescendant(name, 1)
+				} else {
+					c.countDescendant(name, -1)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// countDescendant add delta to the number of descendants of all the ancestors of the name.
+// It must be called with the mutex, or before the cache is shared.
+func (c *ZoneCache) countDescendant(name string, delta int) {
+	for ancestor, ok := utils.Parent(name); ok; ancestor, ok = utils.Parent(ancestor) {
+		count := delta
+
+		if previous, found := c.descendants.Load(ancestor); found {
+			count += previous.(int)
+		}
+
+		if count > 0 {
+			c.descendants.Store(ancestor, count)
+		} else {
+			c.descendants.Delete(ancestor)
+		}
+	}
+}
+
+// HasDescendants look if names below the qname own RRs, an empty non-terminal has descendants but no RRs. c.f RFC 4592 section 2.2.2
+func (c *ZoneCache) HasDescendants(qname string) bool {
+	_, found := c.descendants.Load(utils.ToLowerFQDN(qname))
+	return found
+}
+
+// RRset return a copy of the RRset of type qtype owned by the qname, or nil if there isn't.
+// The RRs are copied because the handler rewrites the owner of the wildcard RRs.
+func (c *ZoneCache) RRset(qname string, qtype uint16) []dns.RR {
+	name, found := c.names.Load(utils.ToLowerFQDN(qname))
+
+	if !found {
+		return nil
+	}
+
+	rrs, found := name.(*cachedName).rrsets[qtype]
+
+	if !found {
+		return nil
+	}
+
+	copies := make([]dns.RR, len(rrs))
+
+	for i, rr := range rrs {
+		copies[i] = dns.Copy(rr)
+	}
+
+	return copies
+}
+
+// Types return the sorted types of the RRsets owned by the qname
+func (c *ZoneCache) Types(qname string) []uint16 {
+	if name, found := c.names.Load(utils.ToLowerFQDN(qname)); found {
+		return name.(*cachedName).types
+	}
+
+	return nil
+}
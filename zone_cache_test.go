@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/suite"
+	bolt "go.etcd.io/bbolt"
+)
+
+type ZoneCacheTestSuite struct {
+	suite.Suite
+	handler  QuestionResolverHandler
+	consumer *KafkaConsumer
+	cache    *ZoneCache
+}
+
+func (suite *ZoneCacheTestSuite) SetupTest() {
+	db := newTestDB(
+		[]dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.1")},
+		[]dns.RR{testRR("foo.internal. 2700 IN TXT \"foo\"")},
+	)
+
+	var err error
+	suite.cache, err = NewZoneCache(db)
+	suite.Nil(err)
+
+	config := DnsConfig{Zones: []string{"internal."}}
+	suite.handler = NewQuestionResolverHandler(db, suite.cache, nil, config, nil)
+	suite.consumer = &KafkaConsumer{db: db, zones: config.Zones, zoneCache: suite.cache}
+}
+
+func (suite *ZoneCacheTestSuite) TearDownTest() {
+	closeTestDB(suite.handler.db)
+}
+
+func (suite *ZoneCacheTestSuite) query(qname string, qtype uint16) *dns.Msg {
+	w := newTestUDPResponseWriter()
+	suite.handler.ServeDNS(w, new(dns.Msg).SetQuestion(qname, qtype))
+
+	return w.msg
+}
+
+func (suite *ZoneCacheTestSuite) TestShouldLoadTheRecordsOfTheDB() {
+	suite.Equal([]uint16{dns.TypeA, dns.TypeTXT}, suite.cache.Types("foo.internal."))
+	suite.Equal("foo.internal.\t2700\tIN\tA\t127.0.0.1", suite.cache.RRset("foo.internal.", dns.TypeA)[0].String())
+	suite.Nil(suite.cache.RRset("foo.internal.", dns.TypeAAAA))
+	suite.Nil(suite.cache.RRset("bar.internal.", dns.TypeA))
+}
+
+func (suite *ZoneCacheTestSuite) TestShouldReturnACopyOfTheRRset() {
+	rrs := suite.cache.RRset("foo.internal.", dns.TypeA)
+	rrs[0].Header().Name = "bar.internal."
+
+	suite.Equal("foo.internal.", suite.cache.RRset("foo.internal.", dns.TypeA)[0].Header().Name)
+}
+
+func (suite *ZoneCacheTestSuite) TestShouldRefreshTheNamesChangedByTheConsumer() {
+	suite.Nil(suite.consumer.registerRecordAsBytesWithTheKeyInDB([]byte("foo.internal.|A"), []dns.RR{testRR("foo.internal. 2700 IN A 127.0.0.2")}, false))
+	suite.Nil(suite.consumer.registerRecordAsBytesWithTheKeyInDB([]byte("bar.internal.|AAAA"), []dns.RR{testRR("bar.internal. 2700 IN AAAA ::1")}, false))
+
+	suite.Equal("foo.internal.\t2700\tIN\tA\t127.0.0.2", suite.cache.RRset("foo.internal.", dns.TypeA)[0].String())
+	suite.Equal("bar.internal.\t2700\tIN\tAAAA\t::1", suite.cache.RRset("bar.internal.", dns.TypeAAAA)[0].String())
+	suite.Equal(uint32(3), firstSOA(suite.cache.RRset("internal.", dns.TypeSOA)).Serial, "the SOA of the zone is refreshed with the record")
+}
+
+func (suite *ZoneCacheTestSuite) TestShouldForgetTheNamesWithoutRecords() {
+	suite.consumer.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RecordBucket)
+		b.Delete([]byte("foo.internal.|A"))
+		return b.Delete([]byte("foo.internal.|TXT"))
+	})
+
+	suite.True(suite.cache.HasDescendants("internal."))
+	suite.Nil(suite.cache.Refresh(suite.consumer.db, "foo.internal."))
+	suite.Nil(suite.cache.Types("foo.internal."))
+	suite.False(suite.cache.HasDescendants("internal."))
+}
+
+func (suite *ZoneCacheTestSuite) TestShouldFindTheNamesWhateverTheirCase() {
+	suite.Nil(suite.consumer.registerRecordAsBytesWithTheKeyInDB([]byte("WWW.Bar.internal.|A"), []dns.RR{testRR("WWW.Bar.internal. 2700 IN A 127.0.0.3")}, false))
+
+	suite.Equal([]uint16{dns.TypeA}, suite.cache.Types("www.bar.internal."))
+	suite.Len(suite.cache.RRset("www.BAR.internal.", dns.TypeA), 1)
+	suite.True(suite.cache.HasDescendants("bar.internal."))
+
+	cache, err := NewZoneCache(suite.consumer.db)
+	suite.Nil(err)
+	suite.Len(cache.RRset("www.bar.internal.", dns.TypeA), 1, "the names are loaded in lowercase")
+}
+
+func (suite *ZoneCacheTestSuite) TestShouldServeTheQueriesFromTheCache() {
+	// Removed from the DB but not from the cache: the handler must not read the DB
+	suite.consumer.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(RecordBucket).Delete([]byte("foo.internal.|A"))
+	})
+
+	msg := suite.query("foo.internal.", dns.TypeA)
+	suite.Equal(dns.RcodeSuccess, msg.Rcode)
+	suite.Len(msg.Answer, 1)
+
+	msg = suite.query("foo.internal.", dns.TypeMX)
+	suite.Equal(dns.RcodeSuccess, msg.Rcode)
+	suite.Empty(msg.Answer, "NODATA for a type missing at an existing name")
+
+	msg = suite.query("bar.internal.", dns.TypeA)
+	suite.Equal(dns.RcodeNameError, msg.Rcode)
+}
+
+func TestZoneCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(ZoneCacheTestSuite))
+}